@@ -0,0 +1,59 @@
+package grace
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+const defaultCheckTimeout = 10 * time.Second
+
+var errCheckTimeout = errors.New("Check timeout")
+
+// CheckError is returned by Restart if new binary fails the check by CheckArgs.
+// No new processor is started, and old processor goes on serving.
+type CheckError struct {
+	Output []byte // Combined stdout and stderr of the check
+	Err    error  // Why the check failed
+}
+
+func (e *CheckError) Error() string {
+	return fmt.Sprintf("Check new binary failed: %v\n%s", e.Err, bytes.TrimSpace(e.Output))
+}
+
+// checkBinary runs the binary new processor would be started from by spec with its
+// arguments followed by CheckArgs, so the deployed config is checked, in the same
+// working directory and environment. It fails unless the check exits with 0 in
+// CheckTimeout.
+func (gs *GraceService) checkBinary(spec *RestartSpec) error {
+	if len(gs.CheckArgs) == 0 {
+		return nil
+	}
+	path, args, dir, err := spec.command()
+	if err != nil {
+		return err
+	}
+	timeout := gs.CheckTimeout
+	if timeout == 0 {
+		timeout = defaultCheckTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Args = append(append([]string(nil), args...), gs.CheckArgs...)
+	cmd.Dir = dir
+	cmd.Env = spec.environ()
+	cmd.WaitDelay = time.Second // Do not wait for the output of processes it leaves
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = errCheckTimeout
+	}
+	if err != nil {
+		return &CheckError{Output: out, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package grace
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	controlName        = "_grace_control" // Name the control socket is passed to new processor by
+	controlReadTimeout = 10 * time.Second // Time given to a client to send its command
+)
+
+// Commands accepted by the control socket, see ControlSocket.
+const (
+	ControlStatus  = "status"  // Reply the status
+	ControlRestart = "restart" // Restart, and reply once new processor is ready or failed
+	ControlStop    = "stop"    // Reply the status, and then drain to stop like ActionGracefulStop
+	ControlDrain   = "drain"   // Fail health checks like draining to stop, but keep serving
+)
+
+var (
+	errUnknownCommand     = errors.New("Unknown control command")
+	errControlStopping    = errors.New("Service stopping")
+	errControlUnsupported = errors.New("Control command not supported by master")
+)
+
+// ControlReply is the reply of a control command, sent as a JSON line.
+type ControlReply struct {
+	OK         bool   `json:"ok"`
+	Error      string `json:"error,omitempty"`
+	Pid        int    `json:"pid"`
+	Generation int    `json:"generation"`
+	Restart    string `json:"restart"`           // RestartState of the service
+	NewPid     int    `json:"new_pid,omitempty"` // Pid of new processor restarting or replacing this one
+	Draining   bool   `json:"draining"`          // Health checks fail, see Draining
+	Conns      int    `json:"conns"`             // Connections open, not counting control connections
+	Workers    []int  `json:"workers,omitempty"` // Pids of workers running, see Supervise
+}
+
+// controlRequest is a command passed from a control connection to waitSignal.
+type controlRequest struct {
+	cmd   string
+	reply chan *ControlReply
+}
+
+// Control sends cmd to the control socket at path, and returns the reply.
+func Control(path, cmd string) (*ControlReply, error) {
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if _, err = c.Write([]byte(cmd + "\n")); err != nil {
+		return nil, err
+	}
+	reply := &ControlReply{}
+	if err = json.NewDecoder(c).Decode(reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// openControl gets the control socket at ControlSocket and serves it, only once. It is
+// called by CloseParentService, and the socket is passed to new processor like other
+// registered sockets. Workers leave the control to their master, which calls it in
+// Supervise.
+func (gs *GraceService) openControl() error {
+	if gs.ControlSocket == "" || IsWorker() {
+		return nil
+	}
+	gs.controlOnce.Do(func() {
+		var gl GraceListener
+		gl, gs.controlErr = gs.GetNamedListener(controlName, "unix", gs.ControlSocket)
+		if gs.controlErr != nil {
+			return
+		}
+		// Control commands are still served when connections are limited.
+		gl.(*gListener).limiter = nil
+		gs.mu.Lock()
+		gs.control = make(chan controlRequest)
+		gs.mu.Unlock()
+		go gs.ServeWith(gl, NewConnServer(ConnHandlerFunc(gs.serveControl)))
+	})
+	return gs.controlErr
+}
+
+// serveControl reads a command line from c, and writes the reply.
+func (gs *GraceService) serveControl(ctx context.Context, c net.Conn) {
+	c.SetReadDeadline(time.Now().Add(controlReadTimeout))
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+
+	var reply *ControlReply
+	switch cmd := strings.TrimSpace(line); cmd {
+	case ControlStatus:
+		reply = gs.controlReply(nil)
+	default:
+		// Others are done by waitSignal.
+		req := controlRequest{cmd: cmd, reply: make(chan *ControlReply, 1)}
+		select {
+		case gs.control <- req:
+			reply = <-req.reply
+		case <-ctx.Done():
+			reply = gs.controlReply(errControlStopping)
+		}
+	}
+	json.NewEncoder(c).Encode(reply)
+}
+
+// controlReply returns the reply with the status of the service, failed by err if not nil.
+func (gs *GraceService) controlReply(err error) *ControlReply {
+	st := gs.RestartStatus()
+	reply := &ControlReply{
+		OK:         err == nil,
+		Pid:        os.Getpid(),
+		Generation: Generation(),
+		Restart:    st.State.String(),
+		NewPid:     st.Pid,
+		Draining:   gs.Draining(),
+	}
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	for _, ns := range gs.registeredSockets(nil) {
+		if l, ok := ns.s.(*gListener); ok && ns.name != controlName {
+			reply.Conns += len(l.liveConns())
+		}
+	}
+	return reply
+}
@@ -0,0 +1,92 @@
+package grace
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// CloseOrder is the order connections still open after ListenerCloseTimeout are closed in.
+type CloseOrder int
+
+const (
+	CloseIdleFirst   CloseOrder = iota // Close idle connections, then active ones
+	CloseActiveFirst                   // Close active connections, then idle ones
+	CloseNone                          // Leave connections open
+)
+
+// DrainTimeoutError is returned when connections are still open after ListenerCloseTimeout.
+type DrainTimeoutError struct {
+	Open         int // Number of connections still open at the deadline
+	ForcedIdle   int // Number of idle connections closed by force
+	ForcedActive int // Number of active connections closed by force
+}
+
+func (e *DrainTimeoutError) Error() string {
+	return fmt.Sprintf("%v: %d connections still open, %d idle and %d active ones closed by force",
+		errListenerCloseTimeout, e.Open, e.ForcedIdle, e.ForcedActive)
+}
+
+// forceClose closes conns in order, and returns the numbers of idle and active ones closed.
+// Connections not served by http servers are regarded as active, see HTTPServer.
+func forceClose(conns []*conn, order CloseOrder) (idle, active int) {
+	if order == CloseNone {
+		return
+	}
+
+	var idleConns, activeConns []*conn
+	for _, c := range conns {
+		if atomic.LoadInt32(&c.idle) == 1 {
+			idleConns = append(idleConns, c)
+		} else {
+			activeConns = append(activeConns, c)
+		}
+	}
+	if order == CloseActiveFirst {
+		closeConns(activeConns)
+		closeConns(idleConns)
+	} else {
+		closeConns(idleConns)
+		closeConns(activeConns)
+	}
+	return len(idleConns), len(activeConns)
+}
+
+func closeConns(conns []*conn) {
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// markIdle tells connection c of a http server whether it is idle by its state.
+func markIdle(c net.Conn, state http.ConnState) {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	gc, ok := c.(*conn)
+	if !ok {
+		return
+	}
+	switch state {
+	case http.StateNew, http.StateIdle:
+		atomic.StoreInt32(&gc.idle, 1)
+	default:
+		atomic.StoreInt32(&gc.idle, 0)
+	}
+}
+
+// shutdownListener is served by a Server, whose Shutdown closes the listener and waits
+// for connections itself. http.Server even closes it while holding a lock needed by
+// closing connections. So the listener must not wait for connections when closed.
+type shutdownListener struct {
+	GraceListener
+}
+
+func (l shutdownListener) Close() error {
+	if gl, ok := l.GraceListener.(*gListener); ok {
+		return gl.close()
+	}
+	return l.GraceListener.Close()
+}
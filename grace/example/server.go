@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
@@ -11,17 +12,13 @@ import (
 )
 
 func main() {
-	ppid := os.Getppid()
-	const msg = "Serving with pid %d ppid %d"
-	log.Printf(msg, os.Getpid(), ppid)
+	const msg = "Serving with pid %d generation %d parent %d"
+	log.Printf(msg, os.Getpid(), grace.Generation(), grace.ParentPID())
 
 	var gs grace.GraceService
 	gs.ListenerCloseTimeout = 10
-
-	gl, err := gs.GetListener("tcp", ":6086")
-	if err != nil {
+	gs.OnRestartError = func(err error) {
 		log.Println(err)
-		return
 	}
 
 	mux := http.NewServeMux()
@@ -29,17 +26,7 @@ func main() {
 		fmt.Fprintf(w, "Welcome to the home page!"+strconv.Itoa(os.Getpid()))
 	})
 
-	go func() {
-		err := gs.Serve(gl, mux)
-		log.Println(err)
-	}()
-
-	err = gs.CloseParentService()
-	if err != nil {
-		log.Println(err)
-	}
-
-	err = gs.WaitSignal(gl)
+	err := gs.Run(context.Background(), grace.HTTP("tcp", ":6086", mux))
 	if err != nil {
 		log.Println(err)
 	}
@@ -1,13 +1,14 @@
 package grace
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"os/signal"
+	"runtime"
 	"strings"
 	"sync"
 	"syscall"
@@ -22,14 +23,12 @@ var (
 )
 
 const (
-	envRestartKey       = "_GRACE_RESTART"
-	envRestartKeyPrefix = envRestartKey + "="
-	errClosed           = "use of closed network connection"
+	errClosed = "use of closed network connection"
 )
 
 // GraceListener requires the file descriptor of listener could be got by File() function.
 // When service restarts, the listener will be passed to child process by file descriptor.
-// So only TCPListener or UNIXListener is supported.
+// So only TCPListener or UnixListener is supported.
 type GraceListener interface {
 	net.Listener                   // Inherit original TCP/UNIX listener interface
 	File() (f *os.File, err error) // Get file descriptor
@@ -39,18 +38,71 @@ type GraceListener interface {
 type gListener struct {
 	GraceListener
 	closed      bool
+	shared      bool          // Served by other processors too, see share
+	keepAlive   time.Duration // Keepalive period of accepted tcp connections, see SocketOptions
+	limiter     *connLimiter
+	done        chan struct{} // Closed when closed, made by doneChan
+	proxy       *ProxyOptions // Serves PROXY protocol if not nil
 	closedMutex sync.RWMutex
 	wg          sync.WaitGroup
+	conns       map[*conn]struct{} // Accepted connections not closed yet
+	connsMutex  sync.Mutex
 }
 
 type conn struct {
 	net.Conn
-	wg   *sync.WaitGroup
-	once sync.Once
+	l     *gListener
+	idle  int32 // 1 if no request is being served, set by http servers
+	once  sync.Once
+	proxy *proxyConn // Reads PROXY protocol header, see NewProxyListener
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	if c.proxy == nil {
+		return c.Conn.Read(b)
+	}
+	if err := c.proxy.init(c.Conn); err != nil {
+		return 0, err
+	}
+	return c.proxy.r.Read(b)
+}
+
+// RemoteAddr returns the source address in the PROXY protocol header if any.
+func (c *conn) RemoteAddr() net.Addr {
+	if c.proxy != nil && c.proxy.init(c.Conn) == nil && c.proxy.src != nil {
+		return c.proxy.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address in the PROXY protocol header if any.
+func (c *conn) LocalAddr() net.Addr {
+	if c.proxy != nil && c.proxy.init(c.Conn) == nil && c.proxy.dst != nil {
+		return c.proxy.dst
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	if c.proxy == nil {
+		return c.Conn.SetDeadline(t)
+	}
+	if err := c.Conn.SetWriteDeadline(t); err != nil {
+		return err
+	}
+	return c.proxy.setReadDeadline(c.Conn, t)
+}
+
+// SetReadDeadline keeps the deadline when the PROXY protocol header is read.
+func (c *conn) SetReadDeadline(t time.Time) error {
+	if c.proxy == nil {
+		return c.Conn.SetReadDeadline(t)
+	}
+	return c.proxy.setReadDeadline(c.Conn, t)
 }
 
 func (c *conn) Close() error {
-	defer c.once.Do(c.wg.Done)
+	defer c.once.Do(func() { c.l.removeConn(c) })
 	return c.Conn.Close()
 }
 
@@ -58,19 +110,78 @@ func NewGraceListener(l GraceListener) GraceListener {
 	return &gListener{GraceListener: l}
 }
 
+// Close closes the listener and waits for all accepted connections to be closed.
 func (l *gListener) Close() error {
+	err := l.close()
+	l.wg.Wait()
+	return err
+}
+
+// close closes the listener only, once.
+func (l *gListener) close() error {
 	l.closedMutex.Lock()
+	if l.closed {
+		l.closedMutex.Unlock()
+		return nil
+	}
 	l.closed = true
+	if l.done != nil {
+		close(l.done)
+	}
+	shared := l.shared
 	l.closedMutex.Unlock()
 
-	var err error
-	if os.Getppid() == 1 {
-		err = l.GraceListener.SetDeadline(time.Now())
-	} else {
-		err = l.GraceListener.Close()
+	// Shared sockets stop accepting but stay open until exit, other processors serve them.
+	if shared {
+		return l.GraceListener.SetDeadline(time.Now())
 	}
-	l.wg.Wait()
-	return err
+	return l.GraceListener.Close()
+}
+
+// share marks the socket served by other processors too, which are new processor
+// after Restart, or the master and other workers of a worker.
+func (l *gListener) share() {
+	l.closedMutex.Lock()
+	l.shared = true
+	l.closedMutex.Unlock()
+}
+
+// accept accepts a connection from the socket. The slot taken for it is freed if
+// accepting fails.
+func (l *gListener) accept() (net.Conn, error) {
+	c, err := l.GraceListener.Accept()
+	if err == nil {
+		return c, nil
+	}
+	if l.limiter != nil && !l.limiter.Reject {
+		l.limiter.release()
+	}
+
+	if strings.HasSuffix(err.Error(), errClosed) {
+		return nil, ErrAlreadyClosed
+	}
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		l.closedMutex.RLock()
+		if l.closed {
+			l.closedMutex.RUnlock()
+			return nil, ErrAlreadyClosed
+		}
+		l.closedMutex.RUnlock()
+	}
+	return nil, err
+}
+
+// doneChan returns the channel closed when the listener is closed.
+func (l *gListener) doneChan() <-chan struct{} {
+	l.closedMutex.Lock()
+	defer l.closedMutex.Unlock()
+	if l.done == nil {
+		l.done = make(chan struct{})
+		if l.closed {
+			close(l.done)
+		}
+	}
+	return l.done
 }
 
 func (l *gListener) Accept() (net.Conn, error) {
@@ -89,192 +200,616 @@ func (l *gListener) Accept() (net.Conn, error) {
 	}
 	l.closedMutex.RUnlock()
 
-	c, err := l.GraceListener.Accept()
-	if err != nil {
-		if strings.HasSuffix(err.Error(), errClosed) {
-			return nil, ErrAlreadyClosed
+	for c == nil {
+		if err := l.limiter.wait(l.doneChan()); err != nil {
+			return nil, err
 		}
-
-		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
-			l.closedMutex.RLock()
-			if l.closed {
-				l.closedMutex.RUnlock()
-				return nil, ErrAlreadyClosed
-			}
-			l.closedMutex.RUnlock()
+		var err error
+		if c, err = l.accept(); err != nil {
+			return nil, err
+		}
+		if !l.limiter.admit(c) {
+			c = nil
+		}
+	}
+	if tc, ok := c.(*net.TCPConn); ok && l.keepAlive != 0 {
+		tc.SetKeepAlive(l.keepAlive > 0)
+		if l.keepAlive > 0 {
+			tc.SetKeepAlivePeriod(l.keepAlive)
 		}
-		return nil, err
 	}
-	return &conn{Conn: c, wg: &l.wg}, nil
+	gc := &conn{Conn: c, l: l}
+	l.closedMutex.RLock()
+	if l.proxy != nil {
+		gc.proxy = &proxyConn{opts: l.proxy}
+	}
+	l.closedMutex.RUnlock()
+	l.connsMutex.Lock()
+	if l.conns == nil {
+		l.conns = make(map[*conn]struct{})
+	}
+	l.conns[gc] = struct{}{}
+	l.connsMutex.Unlock()
+	return gc, nil
+}
+
+func (l *gListener) removeConn(c *conn) {
+	l.connsMutex.Lock()
+	delete(l.conns, c)
+	l.connsMutex.Unlock()
+	l.limiter.release()
+	l.wg.Done()
+}
+
+// liveConns returns the accepted connections which are not closed yet.
+func (l *gListener) liveConns() []*conn {
+	l.connsMutex.Lock()
+	defer l.connsMutex.Unlock()
+	conns := make([]*conn, 0, len(l.conns))
+	for c := range l.conns {
+		conns = append(conns, c)
+	}
+	return conns
 }
 
 type GraceService struct {
 	ListenerCloseTimeout time.Duration
-	srv                  *http.Server
+	ForceCloseOrder      CloseOrder    // How connections still open after ListenerCloseTimeout are closed
+	PreStopDelay         time.Duration // Time listeners are kept open after draining to stop begins
+
+	ReadyTimeout   time.Duration // Time new processor is given to become ready on restart, a minute if 0
+	StartupWindow  time.Duration // Time new processor must keep running after ready before old one drains
+	OnRestartError func(error)   // Called when Restart fails, old processor goes on serving
+	CheckArgs      []string      // Arguments appended to those of new processor to check it before restart, no check if empty
+	CheckTimeout   time.Duration // Time the check is given to exit successfully, 10 seconds if 0
+	RestartSpec    *RestartSpec  // How new processor is started, just like this one if nil
+
+	Workers   int  // Number of workers run by Supervise, 1 if 0
+	ReusePort bool // Workers bind tcp and udp sockets by SO_REUSEPORT rather than share those of Supervise
+
+	PidFile         string      // Written by the processor serving, removed on final shutdown
+	SocketFileMode  os.FileMode // Permission of unix socket files created, umask applies if 0
+	SocketFileOwner string      // "user[:group]" owning unix socket files created, unchanged if empty
+	ControlSocket   string      // Path of unix socket accepting control commands, see ControlStatus and Supervise
+	SocketOptions   SocketOptions
+	ConnLimit       ConnLimit // Limits connections of listeners got by GetNamedListener
+
+	Signals       map[os.Signal]Action   // Actions of signals handled, DefaultSignals if nil
+	OnReload      func() error           // Called on ActionReload before the reload hooks
+	OnReopenLogs  func() error           // Called on ActionReopenLogs
+	OnSignal      func(os.Signal) error  // Called on ActionCustom
+	OnSignalError func(os.Signal, error) // Called when the function called on a signal fails
+
+	mu          sync.Mutex
+	servers     []servedSocket
+	sockets     []namedSocket // Sockets passed to new processor on restart
+	inheritOnce sync.Once
+	inherited   []*inheritedFile // Sockets passed by old processor or systemd
+	inheritErr  error
+	unixOwned   []*net.UnixListener // Inherited unix listeners whose socket files are ours once ready
+	readyOnce   sync.Once
+	reloadHooks []func() error
+	certStores  map[*CertStore]bool // Reloaded by reloadHooks
+	draining    int32               // 1 when draining to stop, see Draining
+
+	controlOnce sync.Once
+	controlErr  error
+	control     chan controlRequest // Control commands done by waitSignal
+
+	restartState   RestartState
+	restartAborted bool     // Set by abortRestart before new processor is started
+	child          *process // New processor of the restart in flight or replacing this one
 }
 
-func (gs *GraceService) closeListener(l GraceListener) (err error) {
-	gs.srv.SetKeepAlivesEnabled(false)
+// closeListener shuts down the servers, closes gl and all registered sockets, and
+// waits for their connections. Idle http connections are closed at once, active ones
+// are waited for. If ListenerCloseTimeout expires, the connections still open are
+// closed by ForceCloseOrder, servers are closed and a *DrainTimeoutError is returned.
+func (gs *GraceService) closeListener(gl GraceListener) error {
+	ctx := context.Background()
+	if gs.ListenerCloseTimeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, gs.ListenerCloseTimeout*time.Second)
+		defer cancel()
+	}
+
+	gs.mu.Lock()
+	servers := append([]servedSocket(nil), gs.servers...)
+	gs.mu.Unlock()
+
+	var (
+		err      error
+		errMutex sync.Mutex
+	)
+	setErr := func(e error) {
+		errMutex.Lock()
+		if err == nil {
+			err = e
+		}
+		errMutex.Unlock()
+	}
 
 	wg := sync.WaitGroup{}
-	wg.Add(1)
-	go func(l GraceListener) {
-		err = l.Close()
-		wg.Done()
-	}(l)
-
-	if gs.ListenerCloseTimeout == 0 {
-		// wait forever... T_T
+	served := make(map[graceSocket]bool)
+	for _, ss := range servers {
+		served[ss.gl] = true
+		wg.Add(1)
+		go func(ss servedSocket) {
+			if e := ss.srv.Shutdown(ctx); e != nil && e != ctx.Err() {
+				setErr(e)
+			}
+			// Closed by Shutdown already, wait for the connections left.
+			if e := ss.gl.Close(); e != nil && e != ErrAlreadyClosed {
+				setErr(e)
+			}
+			wg.Done()
+		}(ss)
+	}
+	// Served listeners are closed by their servers first, so Serve returns
+	// ErrServerClosed, others are closed here.
+	for _, ns := range gs.registeredSockets(gl) {
+		if served[ns.s] {
+			continue
+		}
+		wg.Add(1)
+		go func(s graceSocket) {
+			if e := s.Close(); e != nil && e != ErrAlreadyClosed {
+				setErr(e)
+			}
+			wg.Done()
+		}(ns.s)
+	}
+
+	// wait in background to allow for implementing a timeout
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
 		wg.Wait()
-	} else {
-		// wait in background to allow for implementing a timeout
-		done := make(chan struct{})
-		go func() {
-			defer close(done)
-			wg.Wait()
-		}()
+	}()
 
-		// wait for graceful termination or timeout
-		select {
-		case <-done:
-			// fmt.Println("wg.Wait done")
-		case <-time.After(gs.ListenerCloseTimeout * time.Second):
-			return errListenerCloseTimeout
+	// wait for graceful termination or timeout
+	select {
+	case <-done:
+	case <-ctx.Done():
+		var conns []*conn
+		for _, ns := range gs.registeredSockets(gl) {
+			if l, ok := ns.s.(*gListener); ok {
+				conns = append(conns, l.liveConns()...)
+			}
 		}
+		e := &DrainTimeoutError{Open: len(conns)}
+		e.ForcedIdle, e.ForcedActive = forceClose(conns, gs.ForceCloseOrder)
+		if gs.ForceCloseOrder != CloseNone {
+			for _, ss := range servers {
+				ss.srv.Close()
+			}
+		}
+		return e
 	}
 
-	return
+	errMutex.Lock()
+	defer errMutex.Unlock()
+	return err
 }
 
-// CloseParentService Send TERM signal to old service processor.
-func (gs *GraceService) CloseParentService() error {
-	parentPID := os.Getppid()
-	if parentPID == 1 {
-		return nil
+// CloseParentService tells old service processor this one is ready, so old one starts
+// draining. It should be called once listeners are got and served.
+// Inherited listeners which are not got by new processor are closed, and PidFile is written.
+// Old processor is not told if PidFile can not be written, and goes on serving.
+func (gs *GraceService) CloseParentService() (err error) {
+	if err = gs.openControl(); err != nil {
+		return err
 	}
-	return syscall.Kill(parentPID, syscall.SIGQUIT)
+	gs.closeUnclaimed()
+
+	gs.readyOnce.Do(func() {
+		// Old processor keeps serving unless the pid file is ours.
+		if err = gs.writePidFile(); err != nil {
+			return
+		}
+
+		var notified bool
+		notified, err = notifyReady(gs.ownSocketFiles)
+		if !notified && IsRestarted() {
+			// Old processor does not wait for ready message, send QUIT signal instead.
+			if err = syscall.Kill(ParentPID(), syscall.SIGQUIT); err == nil {
+				gs.ownSocketFiles()
+			}
+		}
+	})
+	return
 }
 
+// GetListener returns the listener inherited from old processor or passed by systemd
+// socket activation, or creates a new one listening on network and addr.
 func (gs *GraceService) GetListener(network, addr string) (gl GraceListener, err error) {
-	isRestart := os.Getenv(envRestartKey)
-	if isRestart == "1" {
-		gl, err = gs.InheritListener()
+	return gs.GetNamedListener("", network, addr)
+}
+
+// GetNamedListener is like GetListener, but prefers the inherited listener with the
+// given name. The name is kept when the listener is passed to new processor, and
+// may not contain ",".
+func (gs *GraceService) GetNamedListener(name, network, addr string) (gl GraceListener, err error) {
+	if err = checkSocketName(name); err != nil {
+		return nil, err
+	}
+	if err = gs.checkPidFile(); err != nil {
+		return nil, err
 	}
 
-	if err != nil || isRestart != "1" {
+	gl, err = gs.activatedListener(name, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if gl == nil {
 		switch network {
 		case "tcp", "tcp4", "tcp6":
-			tcpAddr, err := net.ResolveTCPAddr(network, addr)
+			l, err := gs.listenConfig().Listen(context.Background(), network, addr)
 			if err != nil {
 				return nil, err
 			}
-			l, err := net.ListenTCP(network, tcpAddr)
+			gl = NewGraceListener(l.(*net.TCPListener))
+		case "unix", "unixpacket":
+			gl, err = gs.listenUnix(network, addr)
 			if err != nil {
 				return nil, err
 			}
-			gl = NewGraceListener(l)
 		default:
 			return nil, errNotSupportedNetwork
 		}
+	}
 
+	if l, ok := gl.(*gListener); ok {
+		if err = gs.applyListener(l); err != nil {
+			gl.Close()
+			return nil, err
+		}
+		l.limiter = newConnLimiter(gs.ConnLimit)
 	}
+	gs.RegisterListener(name, gl)
 	return
 }
 
 // InheritListener inherits listener from old processor.
-// File descriptor number of listener is 3 for only stdin, stdout, stderr and listener
-// are opened when restart.
+// File descriptor number of the first listener is 3 for only stdin, stdout, stderr and
+// listeners are opened when restart.
 func (gs *GraceService) InheritListener() (gl GraceListener, err error) {
-	f := os.NewFile(uintptr(3), "")
-	tmp, err := net.FileListener(f)
-	f.Close()
+	files, err := gs.inheritedFiles()
 	if err != nil {
 		return nil, err
 	}
-	l := tmp.(GraceListener)
-	gl = NewGraceListener(l)
-	return
+
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	for _, f := range files {
+		if f.claimed || f.file.Fd() != 3 {
+			continue
+		}
+		l, err := net.FileListener(f.file)
+		if err != nil {
+			return nil, err
+		}
+		f.claim()
+		return gs.inheritedListener(l, f)
+	}
+	return nil, errNoInheritedListener
+}
+
+// servedSocket is a listener served by a server.
+type servedSocket struct {
+	srv Server
+	gl  GraceListener
 }
 
+// Serve serves http requests on gl until the service is shutdown.
 func (gs *GraceService) Serve(gl GraceListener, handler http.Handler) (err error) {
-	gs.srv = &http.Server{Handler: handler}
-	return gs.srv.Serve(gl)
+	return gs.ServeWith(gl, HTTPServer(&http.Server{Handler: handler}))
 }
 
-func (gs *GraceService) Restart(gl GraceListener) (err error) {
-	if gl == nil {
-		return errRestartListener
-	}
+// ServeWith serves gl by srv until the service is shutdown.
+// srv is shutdown when the service drains.
+func (gs *GraceService) ServeWith(gl GraceListener, srv Server) (err error) {
+	gs.mu.Lock()
+	gs.servers = append(gs.servers, servedSocket{srv, gl})
+	gs.mu.Unlock()
+	return srv.Serve(shutdownListener{gl})
+}
 
-	// Extract the file descriptor from the listener.
-	f, err := gl.File()
-	if err != nil {
+// Restart starts new processor and passes gl and all registered sockets to it.
+// It returns after new processor is ready, see CloseParentService, and has kept running
+// in StartupWindow. Otherwise new processor is killed and a *RestartError is returned.
+// Old processor should go on serving whenever Restart fails. If CheckArgs is set, new
+// binary is checked first, and a *CheckError is returned if the check fails.
+//
+// Only one restart is in flight at a time, Restart returns ErrRestartInProgress if
+// called meanwhile, and ErrReplaced once new processor has taken over.
+func (gs *GraceService) Restart(gl GraceListener) error {
+	return gs.RestartWith(gl, gs.RestartSpec)
+}
+
+// RestartWith is Restart starting new processor by spec rather than RestartSpec.
+func (gs *GraceService) RestartWith(gl GraceListener, spec *RestartSpec) (err error) {
+	if err = gs.beginRestart(); err != nil {
 		return err
 	}
-	defer f.Close()                  // Close listener file descriptor when old processor exit
-	syscall.CloseOnExec(int(f.Fd())) // Make sure file descriptor for listener in new process is closed
+	defer func() {
+		gs.endRestart(err)
+		if err != nil {
+			gs.reportRestartError(err)
+		}
+	}()
 
-	// Use the original binary location. This works with symlinks such that if
-	// the file it points to has been changed we will use the updated symlink.
-	argv0, err := exec.LookPath(os.Args[0])
+	ss := gs.registeredSockets(gl)
+	if len(ss) == 0 {
+		return errRestartListener
+	}
+	if err = gs.checkBinary(spec); err != nil {
+		return err
+	}
+	p, r, err := spawnProcess(ss, Generation()+1, spec)
 	if err != nil {
 		return err
 	}
+	defer r.Close()
+	gs.setChild(p)
+	if err = gs.waitReady(p, r); err != nil {
+		gs.reclaimPidFile(p.Pid)
+		return err
+	}
 
-	// In order to keep the working directory the same as when we started.
-	wd, err := os.Getwd()
+	// Sockets are served by new processor, old processor must not remove socket files
+	// when closing.
+	for _, ns := range ss {
+		keepSocketFile(ns.s)
+		if l, ok := ns.s.(*gListener); ok {
+			l.share()
+		}
+	}
+	return nil
+}
+
+func (gs *GraceService) reportRestartError(err error) {
+	if gs.OnRestartError != nil {
+		gs.OnRestartError(err)
+	}
+}
+
+// startProcess starts new processor by spec, of generation gen with sockets ss and
+// extra environment env, and waits for it to be ready. It is killed if abort is closed
+// meanwhile.
+func (gs *GraceService) startProcess(ss []namedSocket, gen int, spec *RestartSpec, abort <-chan struct{}, env ...string) (*process, error) {
+	select {
+	case <-abort:
+		return nil, errStartAborted
+	default:
+	}
+	proc, r, err := spawnProcess(ss, gen, spec, env...)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer r.Close()
 
-	var env []string
-	for _, v := range os.Environ() {
-		if !strings.HasPrefix(v, envRestartKeyPrefix) {
-			env = append(env, v)
+	waited := make(chan struct{})
+	defer close(waited)
+	go func() {
+		select {
+		case <-abort:
+			proc.Kill()
+		case <-waited:
 		}
+	}()
+	if err = gs.waitReady(proc, r); err != nil {
+		return nil, err
 	}
-	env = append(env, fmt.Sprintf("%s%d", envRestartKeyPrefix, 1))
+	return proc, nil
+}
 
-	allFiles := append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, f)
-	_, err = os.StartProcess(argv0, os.Args, &os.ProcAttr{
-		Dir:   wd,
+// spawnProcess starts new processor by spec, of generation gen with sockets ss and extra
+// environment env. It returns the pipe new processor writes readyMessage to, see readyPipe.
+func spawnProcess(ss []namedSocket, gen int, spec *RestartSpec, env ...string) (*process, *os.File, error) {
+	// Extract the file descriptors from the sockets.
+	files, socketsEnv, err := socketFiles(ss)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, f := range files {
+		defer f.Close() // Close listener file descriptor when old processor exit
+	}
+
+	extra, filesEnv, err := spec.extraFiles(3 + len(files))
+	if err != nil {
+		return nil, nil, err
+	}
+	files = append(files, extra...)
+
+	argv0, args, dir, err := spec.command()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// New processor writes to the pipe when it is ready.
+	r, w, err := readyPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	env = append(env, spec.environ()...)
+	env = append(env, fmt.Sprintf("%s=%d", envGenerationKey, gen))
+	env = append(env, fmt.Sprintf("%s=%d", envParentPIDKey, os.Getpid()))
+	env = append(env, envListenersKey+"="+socketsEnv)
+	if filesEnv != "" {
+		env = append(env, envFilesKey+"="+filesEnv)
+	}
+	env = append(env, fmt.Sprintf("%s=%d", envReadyFDKey, 3+len(files)))
+
+	allFiles := append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, files...)
+	allFiles = append(allFiles, w)
+	p, err := forkExec(argv0, args, dir, env, allFiles)
+	w.Close() // Only new processor writes to the pipe, so reading ends if it exits
+	if err != nil {
+		r.Close()
+		return nil, nil, err
+	}
+	return watchProcess(p), r, nil
+}
+
+// forkExec is os.StartProcess, but keeps files in nonblocking mode. os.StartProcess
+// puts them into blocking mode by Fd, which would apply to the sockets shared with
+// other processors, and tie up their threads accepting with no deadline.
+func forkExec(argv0 string, args []string, dir string, env []string, files []*os.File) (*os.Process, error) {
+	fds := make([]uintptr, len(files))
+	for i, f := range files {
+		rc, err := f.SyscallConn()
+		if err != nil {
+			return nil, err
+		}
+		if err = rc.Control(func(fd uintptr) { fds[i] = fd }); err != nil {
+			return nil, err
+		}
+	}
+	pid, err := syscall.ForkExec(argv0, args, &syscall.ProcAttr{
+		Dir:   dir,
 		Env:   env,
-		Files: allFiles,
+		Files: fds,
 	})
-	return err
+	runtime.KeepAlive(files)
+	if err != nil {
+		return nil, &os.PathError{Op: "fork/exec", Path: argv0, Err: err}
+	}
+	return os.FindProcess(pid)
+}
+
+// baseEnv returns the environment of this processor without the variables passing
+// sockets and roles, which are set for new processor only.
+func baseEnv() (env []string) {
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, envGenerationKey+"=") &&
+			!strings.HasPrefix(v, envParentPIDKey+"=") &&
+			!strings.HasPrefix(v, envRestartKey+"=") &&
+			!strings.HasPrefix(v, envListenersKey+"=") &&
+			!strings.HasPrefix(v, envFilesKey+"=") &&
+			!strings.HasPrefix(v, envReadyFDKey+"=") &&
+			!strings.HasPrefix(v, envWorkerKey+"=") &&
+			!isSystemdEnv(v) {
+			env = append(env, v)
+		}
+	}
+	return env
 }
 
-// WaitSignal waits for signals to gracefully terminate or restart the process.
+// WaitSignal waits for signals to gracefully terminate or restart the process, or to do
+// other actions by Signals. PidFile is removed when returning, unless new processor has
+// taken it over.
 func (gs *GraceService) WaitSignal(gl GraceListener) error {
+	return gs.waitSignal(context.Background(), gl, nil)
+}
 
-	ch := make(chan os.Signal, 6)
-	signal.Notify(ch,
-		syscall.SIGTERM, // TERM : Shutdown
-		syscall.SIGINT,  // INT  : Shutdown
-		syscall.SIGQUIT, // QUIT : Gracefully shutdown
-		syscall.SIGHUP,  // HUP  : Gracefully reload configure and restart
-	// syscall.SIGUSR1, // USR1 : Reopen log file
-	// syscall.SIGUSR2, // USR2 : Gracefully restart
+// waitSignal is WaitSignal which also drains and returns when ctx is done, or when an
+// error is received from serveErr.
+func (gs *GraceService) waitSignal(ctx context.Context, gl GraceListener, serveErr <-chan error) error {
+	defer gs.removePidFile()
+
+	actions := gs.signalActions()
+	ch := notifySignals(actions)
+	defer signal.Stop(ch)
+
+	// Restart runs in background so that signals and control commands are handled
+	// meanwhile. Restart requests received then are coalesced into the restart in flight.
+	var (
+		restarting chan error
+		waiters    []chan *ControlReply // Control connections waiting for the restart in flight
 	)
+	startRestart := func() {
+		if restarting != nil {
+			return
+		}
+		done := make(chan error, 1)
+		go func() {
+			done <- gs.Restart(gl)
+		}()
+		restarting = done
+	}
+	endRestart := func(err error) {
+		restarting = nil
+		for _, w := range waiters {
+			w <- gs.controlReply(err)
+		}
+		waiters = nil
+	}
+	abortRestart := func() {
+		if restarting != nil {
+			gs.abortRestart()
+			endRestart(<-restarting)
+		}
+	}
 
+	gs.mu.Lock()
+	control := gs.control
+	gs.mu.Unlock()
 	for {
-		sig := <-ch
-		switch sig {
-		case syscall.SIGTERM:
-			fallthrough
-		case syscall.SIGINT:
-			// this ensures a subsequent TERM will trigger standard go behaviour of
-			// terminating.
-			signal.Stop(ch)
-			return nil
-		case syscall.SIGQUIT:
-			signal.Stop(ch)
-			return gs.closeListener(gl)
-		case syscall.SIGHUP:
-			// we only return here if there's an error, otherwise the new process
-			// will send us a TERM when it's ready to trigger the actual shutdown.
-			if err := gs.Restart(gl); err != nil {
-				return err
+		select {
+		case <-ctx.Done():
+			abortRestart()
+			return gs.stop(gl)
+		case err := <-serveErr:
+			abortRestart()
+			gs.stop(gl)
+			return err
+		case err := <-restarting:
+			endRestart(err)
+			// Once the new process is ready, we drain and return. We keep serving
+			// if the new process fails, the error is reported by OnRestartError.
+			if err == nil {
+				signal.Stop(ch)
+				return gs.closeListener(gl)
+			}
+		case req := <-control:
+			switch req.cmd {
+			case ControlRestart:
+				waiters = append(waiters, req.reply)
+				startRestart()
+			case ControlStop:
+				signal.Stop(ch)
+				abortRestart()
+				req.reply <- gs.controlReply(nil)
+				return gs.stop(gl)
+			case ControlDrain:
+				gs.drain()
+				req.reply <- gs.controlReply(nil)
+			default:
+				req.reply <- gs.controlReply(errUnknownCommand)
+			}
+		case sig := <-ch:
+			action := actions[sig]
+			if action == ActionReload {
+				err := gs.Reload()
+				if err == nil {
+					continue
+				}
+				gs.reportSignalError(sig, err)
+				// Fall back to restart, which reloads everything.
+				action = ActionRestart
+			}
+
+			switch action {
+			case ActionFastStop:
+				// this ensures a subsequent TERM will trigger standard go behaviour of
+				// terminating.
+				signal.Stop(ch)
+				abortRestart()
+				return nil
+			case ActionGracefulStop:
+				signal.Stop(ch)
+				abortRestart()
+				return gs.stop(gl)
+			case ActionRestart:
+				// Workers are restarted by their master.
+				if !IsWorker() {
+					startRestart()
+				}
+			default:
+				gs.handleSignal(sig, action)
 			}
 		}
 	}
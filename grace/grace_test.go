@@ -0,0 +1,1437 @@
+package grace
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestActivatedListener(t *testing.T) {
+	var files []*inheritedFile
+	var addrs []string
+	for _, name := range []string{"http", "admin"} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := l.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, l.Addr().String())
+		l.Close()
+		files = append(files, &inheritedFile{name: name, file: f})
+	}
+
+	var gs GraceService
+	gs.inheritOnce.Do(func() { gs.inherited = files })
+
+	gl, err := gs.activatedListener("admin", "tcp", ":1")
+	if err != nil || gl == nil {
+		t.Fatal("Listener not found by name", err)
+	}
+	if gl.Addr().String() != addrs[1] {
+		t.Error("Wrong listener by name", gl.Addr())
+	}
+	gl.Close()
+
+	gl, err = gs.activatedListener("", "tcp", addrs[0])
+	if err != nil || gl == nil {
+		t.Fatal("Listener not found by address", err)
+	}
+	gl.Close()
+
+	gl, err = gs.activatedListener("admin", "tcp", addrs[1])
+	if err != nil || gl != nil {
+		t.Error("Listener claimed twice", err)
+	}
+}
+
+// helperCommand runs the test binary as a child process doing TestHelperProcess.
+func helperCommand(helper string, env ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$")
+	cmd.Env = append(append(os.Environ(), env...), "GRACE_TEST_HELPER="+helper)
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// TestHelperProcess is not a test, but the child process of other tests.
+func TestHelperProcess(t *testing.T) {
+	switch os.Getenv("GRACE_TEST_HELPER") {
+	case "":
+		return
+	case "systemd":
+		// systemd sets LISTEN_PID after forking.
+		os.Setenv(envListenPID, strconv.Itoa(os.Getpid()))
+		var gs GraceService
+		admin, err := gs.GetNamedListener("admin", "tcp", "127.0.0.1:1")
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		web, err := gs.GetListener("tcp", os.Getenv("GRACE_TEST_ADDR"))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println(admin.Addr(), web.Addr(), os.Getenv(envListenFDs) == "")
+	case "legacy":
+		var gs GraceService
+		gl, err := gs.GetListener("tcp", os.Getenv("GRACE_TEST_ADDR"))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println(gl.Addr(), Generation(), ParentPID() == os.Getppid(), gs.CloseParentService())
+	case "supervise":
+		var gs GraceService
+		if IsWorker() {
+			fmt.Println("worker", os.Getpid())
+			if _, err := os.Stat(os.Getenv("GRACE_TEST_SLOW")); err == nil {
+				// Never ready in time.
+				time.Sleep(time.Minute)
+			}
+			err := gs.Run(context.Background(), HTTP("tcp", os.Getenv("GRACE_TEST_ADDR"),
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					fmt.Fprint(w, os.Getpid())
+				})))
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			break
+		}
+		gs.Workers = 2
+		gs.ControlSocket = os.Getenv("GRACE_TEST_CONTROL")
+		gl, err := gs.GetListener("tcp", "127.0.0.1:0")
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		os.Setenv("GRACE_TEST_ADDR", gl.Addr().String())
+		fmt.Println("master", gl.Addr())
+		if err = gs.Supervise(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	os.Exit(0)
+}
+
+func TestSystemdFiles(t *testing.T) {
+	// Sockets addressed to another process are left alone.
+	t.Setenv(envListenPID, strconv.Itoa(os.Getppid()))
+	t.Setenv(envListenFDs, "1")
+	t.Setenv(envListenFDNames, "http")
+	if files, err := systemdFiles(); files != nil || err != nil {
+		t.Error("Sockets of another process", files, err)
+	}
+	for _, key := range []string{envListenPID, envListenFDs, envListenFDNames} {
+		if _, ok := os.LookupEnv(key); ok {
+			t.Error("Environment not cleared", key)
+		}
+	}
+
+	t.Setenv(envListenPID, strconv.Itoa(os.Getpid()))
+	t.Setenv(envListenFDs, "x")
+	if _, err := systemdFiles(); err != errInvalidListenFDs {
+		t.Error("Invalid LISTEN_FDS", err)
+	}
+
+	var files []*os.File
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		f, err := l.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files = append(files, f)
+		addrs = append(addrs, l.Addr().String())
+	}
+	cmd := helperCommand("systemd", envListenFDs+"=2", envListenFDNames+"=http:admin", "GRACE_TEST_ADDR="+addrs[0])
+	cmd.ExtraFiles = files
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err, string(out))
+	}
+	if want := addrs[1] + " " + addrs[0] + " true\n"; string(out) != want {
+		t.Errorf("Got %q, want %q", out, want)
+	}
+}
+
+func TestSocketFiles(t *testing.T) {
+	var gs GraceService
+	for _, name := range []string{"http", "admin"} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		gs.RegisterListener(name, NewGraceListener(l.(*net.TCPListener)))
+	}
+
+	files, env, err := socketFiles(gs.registeredSockets(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		f.Close()
+	}
+	if len(files) != 2 || env != "http:3,admin:4" {
+		t.Error("Unexpected listener files", len(files), env)
+	}
+
+	// "," would split the name:fd pairs.
+	if _, err = gs.GetNamedListener("http,admin", "tcp", "127.0.0.1:0"); err != errInvalidSocketName {
+		t.Error("Invalid listener name", err)
+	}
+	if _, err = gs.GetNamedPacketConn("http,admin", "udp", "127.0.0.1:0"); err != errInvalidSocketName {
+		t.Error("Invalid packet conn name", err)
+	}
+	if len(gs.registeredSockets(nil)) != 2 {
+		t.Error("Socket registered with invalid name")
+	}
+}
+
+func TestUnixListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "grace.sock")
+	gs := GraceService{SocketFileMode: 0600}
+	gl, err := gs.GetListener("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Error("Unexpected socket file mode", err)
+	}
+
+	if _, err = gs.GetListener("unix", path); err != errSocketInUse {
+		t.Error("Socket file in use is removed", err)
+	}
+
+	// Socket file is left as if it were handed over to new processor
+	keepSocketFile(gl)
+	gl.(*gListener).GraceListener.Close()
+	if _, err = os.Stat(path); err != nil {
+		t.Fatal("Socket file removed by old processor", err)
+	}
+
+	gl, err = gs.GetListener("unix", path)
+	if err != nil {
+		t.Fatal("Stale socket file is not removed", err)
+	}
+	gl.(*gListener).GraceListener.Close()
+}
+
+func TestInheritedUnixListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "grace.sock")
+	inherit := func(gs *GraceService) {
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := l.(*net.UnixListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.(*net.UnixListener).SetUnlinkOnClose(false)
+		l.Close()
+		gs.inheritOnce.Do(func() {
+			gs.inherited = []*inheritedFile{{file: f, fromParent: true}}
+		})
+	}
+
+	// New processor failing to start leaves the socket file to old processor.
+	var gs GraceService
+	inherit(&gs)
+	_, err := gs.GetListener("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs.closeListener(nil)
+	if _, err = os.Stat(path); err != nil {
+		t.Fatal("Socket file removed by new processor failing to start", err)
+	}
+
+	// New processor exiting in StartupWindow of old processor leaves the socket file too.
+	ready := func(gs *GraceService) *os.File {
+		os.Remove(path)
+		inherit(gs)
+		r, w, err := readyPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fd, err := syscall.Dup(int(w.Fd()))
+		w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv(envReadyFDKey, strconv.Itoa(fd))
+		if _, err = gs.GetListener("unix", path); err != nil {
+			t.Fatal(err)
+		}
+		if err = gs.CloseParentService(); err != nil {
+			t.Fatal(err)
+		}
+		msg := make([]byte, len(readyMessage))
+		if _, err = io.ReadFull(r, msg); err != nil || string(msg) != readyMessage {
+			t.Fatal("Not ready", string(msg), err)
+		}
+		return r
+	}
+	var exited GraceService
+	r := ready(&exited)
+	exited.closeListener(nil)
+	r.Close()
+	if _, err = os.Stat(path); err != nil {
+		t.Fatal("Socket file removed in startup window", err)
+	}
+
+	// The socket file belongs to new processor once old processor hands over.
+	var owner GraceService
+	r = ready(&owner)
+	defer r.Close()
+	io.WriteString(r, handOverMessage)
+	for i := 0; i < 100; i++ {
+		owner.mu.Lock()
+		owned := owner.unixOwned == nil
+		owner.mu.Unlock()
+		if owned {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	owner.closeListener(nil)
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Error("Socket file left by new processor", err)
+	}
+}
+
+func TestPacketConnClose(t *testing.T) {
+	var gs GraceService
+	pc, err := gs.GetPacketConn("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, _, err := pc.ReadFrom(make([]byte, 512))
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	if err = pc.Close(); err != nil {
+		t.Error(err)
+	}
+	if err = <-done; err != ErrAlreadyClosed {
+		t.Error("Pending read is not stopped", err)
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	gs := GraceService{ReadyTimeout: 100 * time.Millisecond, StartupWindow: 100 * time.Millisecond}
+	for _, c := range []struct {
+		argv []string
+		err  error
+	}{
+		{[]string{"sh", "-c", "printf 'ready\n' >&3; exec sleep 10"}, nil},
+		{[]string{"sh", "-c", "exit 0"}, errNotReady},
+		{[]string{"sh", "-c", "exec sleep 10"}, errReadyTimeout},
+		{[]string{"sh", "-c", "printf 'ready\n' >&3; exit 1"}, errStartupExited},
+	} {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := os.StartProcess("/bin/sh", c.argv, &os.ProcAttr{
+			Files: []*os.File{nil, nil, nil, w},
+		})
+		w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = gs.waitReady(watchProcess(p), r)
+		if re, ok := err.(*RestartError); ok {
+			err = re.Err
+		}
+		if err != c.err {
+			t.Error(c.argv, err)
+		}
+		p.Kill()
+		r.Close()
+	}
+}
+
+func TestPidFile(t *testing.T) {
+	gs := GraceService{PidFile: filepath.Join(t.TempDir(), "grace.pid")}
+
+	p, err := os.StartProcess("/bin/sleep", []string{"sleep", "10"}, &os.ProcAttr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Wait()
+	defer p.Kill()
+	if err = os.WriteFile(gs.PidFile, []byte(strconv.Itoa(p.Pid)+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = gs.checkPidFile(); err != errPidFileInUse {
+		t.Error("Pid file of running process is not detected", err)
+	}
+	gs.removePidFile()
+	if _, err = os.Stat(gs.PidFile); err != nil {
+		t.Error("Pid file of another process is removed", err)
+	}
+
+	if err = gs.writePidFile(); err != nil {
+		t.Fatal(err)
+	}
+	if pid, err := readPidFile(gs.PidFile); err != nil || pid != os.Getpid() {
+		t.Error("Unexpected pid file", pid, err)
+	}
+	gs.removePidFile()
+	if _, err = os.Stat(gs.PidFile); !os.IsNotExist(err) {
+		t.Error("Pid file is not removed", err)
+	}
+
+	// Old processor goes on serving if new one fails to write the pid file.
+	r, w, err := readyPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	t.Setenv(envReadyFDKey, strconv.Itoa(int(w.Fd())))
+	gs = GraceService{PidFile: filepath.Join(t.TempDir(), "nodir", "grace.pid")}
+	if err = gs.CloseParentService(); !os.IsNotExist(err) {
+		t.Error("Pid file written", err)
+	}
+	r.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := r.Read(make([]byte, len(readyMessage))); !os.IsTimeout(err) {
+		t.Error("Old processor told ready", n, err)
+	}
+}
+
+func TestPidFileRestartFailed(t *testing.T) {
+	gs := GraceService{
+		PidFile:       filepath.Join(t.TempDir(), "grace.pid"),
+		StartupWindow: time.Second,
+	}
+	gl, err := gs.GetListener("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gl.Close()
+	if err = gs.writePidFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	// New processor writes the pid file and exits in the startup window.
+	spec := &RestartSpec{
+		Path: "/bin/sh",
+		Args: []string{"sh", "-c", `echo $$ > "$GRACE_TEST_PIDFILE"; printf 'ready\n' >&4; exit 1`},
+		Env:  []string{"GRACE_TEST_PIDFILE=" + gs.PidFile},
+	}
+	err = gs.RestartWith(gl, spec)
+	if re, ok := err.(*RestartError); !ok || re.Err != errStartupExited {
+		t.Fatal("Unexpected restart result", err)
+	}
+	if pid, err := readPidFile(gs.PidFile); err != nil || pid != os.Getpid() {
+		t.Error("Pid file not reclaimed", pid, err)
+	}
+}
+
+func TestCloseListenerDrain(t *testing.T) {
+	gs := GraceService{ListenerCloseTimeout: 1}
+	gl, err := gs.GetListener("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	go gs.Serve(gl, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			<-release
+		}
+	}))
+
+	// An idle keep-alive connection and an active request
+	url := "http://" + gl.Addr().String()
+	resp, err := http.Get(url + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	go http.Get(url + "/block")
+	time.Sleep(50 * time.Millisecond)
+
+	err = gs.closeListener(gl)
+	if e, ok := err.(*DrainTimeoutError); !ok || e.Open != 1 || e.ForcedActive != 1 {
+		t.Error("Unexpected drain result", err)
+	}
+	if conns := gl.(*gListener).liveConns(); len(conns) != 0 {
+		t.Error("Connections left open", len(conns))
+	}
+	close(release)
+}
+
+func TestConnServer(t *testing.T) {
+	gs := GraceService{ListenerCloseTimeout: 1}
+	gl, err := gs.GetListener("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewConnServer(ConnHandlerFunc(func(ctx context.Context, c net.Conn) {
+		<-ctx.Done()
+		c.Write([]byte("bye"))
+	}))
+	served := make(chan error)
+	go func() {
+		served <- gs.ServeWith(gl, srv)
+	}()
+
+	c, err := net.Dial("tcp", gl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	if err = gs.closeListener(gl); err != nil {
+		t.Error(err)
+	}
+	if err = <-served; err != ErrServerClosed {
+		t.Error("Unexpected serve result", err)
+	}
+	b, err := io.ReadAll(c)
+	if string(b) != "bye" {
+		t.Error("Connection is not finished by handler", string(b), err)
+	}
+}
+
+func TestSignalActions(t *testing.T) {
+	// Keep the signals from terminating the test before they are handled.
+	guard := make(chan os.Signal, 2)
+	signal.Notify(guard, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer signal.Stop(guard)
+
+	custom := make(chan os.Signal, 1)
+	gs := GraceService{
+		Signals: map[os.Signal]Action{
+			syscall.SIGUSR1: ActionCustom,
+			syscall.SIGUSR2: ActionGracefulStop,
+		},
+		OnSignal: func(sig os.Signal) error {
+			custom <- sig
+			return nil
+		},
+	}
+	done := make(chan error)
+	go func() {
+		done <- gs.WaitSignal(nil)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+	if sig := <-custom; sig != syscall.SIGUSR1 {
+		t.Error("Unexpected custom signal", sig)
+	}
+	syscall.Kill(os.Getpid(), syscall.SIGUSR2)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Error("WaitSignal does not stop")
+	}
+}
+
+func TestReloadHandler(t *testing.T) {
+	handler := func(body string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, body)
+		})
+	}
+	sh := NewSwappableHandler(handler("old"))
+
+	var gs GraceService
+	gs.AddReloadHook(func() error {
+		sh.Swap(handler("new"))
+		return nil
+	})
+	failed := errors.New("bad config")
+	gs.AddReloadHook(func() error {
+		return failed
+	})
+	if err := gs.Reload(); err != failed {
+		t.Error("Reload error is lost", err)
+	}
+
+	w := httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Body.String() != "new" {
+		t.Error("Handler is not swapped", w.Body.String())
+	}
+}
+
+// writeKeyPair writes a self-signed certificate for host and its key to dir.
+func writeKeyPair(t *testing.T, dir, host string) KeyPair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := KeyPair{CertFile: filepath.Join(dir, host+".crt"), KeyFile: filepath.Join(dir, host+".key")}
+	err = os.WriteFile(p.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err == nil {
+		err = os.WriteFile(p.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestCertStore(t *testing.T) {
+	dir := t.TempDir()
+	cs, err := NewCertStore(writeKeyPair(t, dir, "a.example.com"), writeKeyPair(t, dir, "b.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hello := func(name string) *tls.ClientHelloInfo {
+		return &tls.ClientHelloInfo{
+			ServerName:        name,
+			SupportedVersions: []uint16{tls.VersionTLS13},
+			SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		}
+	}
+	cert, err := cs.GetCertificate(hello("b.example.com"))
+	if err != nil || cert.Leaf.Subject.CommonName != "b.example.com" {
+		t.Fatal("Certificate is not chosen by SNI", err)
+	}
+
+	writeKeyPair(t, dir, "b.example.com")
+	if err = cs.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, _ := cs.GetCertificate(hello("b.example.com"))
+	if reloaded == cert || reloaded.Leaf.SerialNumber.Cmp(cert.Leaf.SerialNumber) == 0 {
+		t.Error("Certificate is not reloaded")
+	}
+
+	os.Remove(filepath.Join(dir, "a.example.com.key"))
+	if err = cs.Reload(); err == nil {
+		t.Error("Missing key file is not reported")
+	}
+	if cert, _ = cs.GetCertificate(hello("b.example.com")); cert != reloaded {
+		t.Error("Certificates are dropped when reloading fails")
+	}
+}
+
+func TestPreStopHealth(t *testing.T) {
+	gs := GraceService{ListenerCloseTimeout: 1, PreStopDelay: 200 * time.Millisecond}
+	gl, err := gs.GetListener("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go gs.Serve(gl, gs.HealthHandler())
+	url := "http://" + gl.Addr().String() + "/health"
+
+	resp, err := http.Get(url)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("Unexpected health before draining", err)
+	}
+	resp.Body.Close()
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- gs.stop(gl)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// Still accepting in the pre-stop delay, but unhealthy
+	resp, err = http.Get(url)
+	if err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatal("Unexpected health while draining", err)
+	}
+	resp.Body.Close()
+
+	if err = <-stopped; err != nil {
+		t.Error(err)
+	}
+	if _, err = http.Get(url); err == nil {
+		t.Error("Listener is not closed after pre-stop delay")
+	}
+}
+
+func TestRestartState(t *testing.T) {
+	gs := GraceService{}
+	if err := gs.beginRestart(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gs.beginRestart(); err != ErrRestartInProgress {
+		t.Error("Overlapping restart", err)
+	}
+
+	// A restart aborted before new processor is recorded kills it at once.
+	gs.abortRestart()
+	p, err := os.StartProcess("/bin/sh", []string{"sh", "-c", "exec sleep 10"}, &os.ProcAttr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proc := watchProcess(p)
+	gs.setChild(proc)
+	select {
+	case <-proc.exited:
+	case <-time.After(time.Second):
+		p.Kill()
+		t.Error("Aborted processor not killed")
+	}
+	if st := gs.RestartStatus(); st.State != Restarting || st.Pid != p.Pid {
+		t.Error("Unexpected status", st)
+	}
+
+	gs.endRestart(errNotReady)
+	if st := gs.RestartStatus(); st.State != RestartIdle || st.Pid != 0 {
+		t.Error("Unexpected status", st)
+	}
+	if err := gs.beginRestart(); err != nil {
+		t.Fatal(err)
+	}
+	gs.endRestart(nil)
+	if err := gs.Restart(nil); err != ErrReplaced {
+		t.Error("Restart after replaced", err)
+	}
+}
+
+func TestHandOff(t *testing.T) {
+	var gs GraceService
+	gl, err := gs.GetListener("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := gl.Addr().String()
+
+	// Handed over listener stops accepting, but keeps the socket open.
+	gl.(*gListener).share()
+	if err = gl.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = gl.Accept(); err != ErrAlreadyClosed {
+		t.Error("Accept after close", err)
+	}
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("Handed over socket closed", err)
+	}
+	c.Close()
+	gl.(*gListener).GraceListener.Close()
+}
+
+func TestLegacyParent(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGQUIT)
+	defer signal.Stop(quit)
+
+	// Old processor of an earlier release only sets _GRACE_RESTART=1.
+	cmd := helperCommand("legacy", envRestartKey+"=1", "GRACE_TEST_ADDR="+l.Addr().String())
+	cmd.ExtraFiles = []*os.File{f}
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err, string(out))
+	}
+	if want := l.Addr().String() + " 1 true <nil>\n"; string(out) != want {
+		t.Errorf("Got %q, want %q", out, want)
+	}
+	select {
+	case <-quit:
+	case <-time.After(time.Second):
+		t.Error("Old processor not sent QUIT signal")
+	}
+}
+
+func TestRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "grace.sock")
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hi")
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	var gs GraceService
+	go func() {
+		done <- gs.Run(ctx, HTTP("unix", path, h))
+	}()
+
+	client := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	}}
+	served := false
+	for i := 0; i < 50 && !served; i++ {
+		resp, err := client.Get("http://grace/")
+		if err != nil {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != "hi" {
+			t.Error("Unexpected response", string(b))
+		}
+		served = true
+	}
+	if !served {
+		t.Error("Not served")
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run does not return when ctx is done")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("Socket file left", err)
+	}
+}
+
+// failingServer fails serving with err.
+type failingServer struct {
+	Server
+	err error
+}
+
+func (s failingServer) Serve(l net.Listener) error {
+	return s.err
+}
+
+func TestRunServeError(t *testing.T) {
+	serveErr := errors.New("Serve failed")
+	b := HTTP("tcp", "127.0.0.1:0", http.NotFoundHandler())
+	b.Server = failingServer{b.Server, serveErr}
+	var gs GraceService
+	done := make(chan error, 1)
+	go func() {
+		done <- gs.Run(context.Background(), b)
+	}()
+
+	select {
+	case err := <-done:
+		if err != serveErr {
+			t.Error("Unexpected error", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run does not return when a server fails")
+	}
+}
+
+func TestCheckBinary(t *testing.T) {
+	// The test binary is checked, which fails with usage on unknown flags.
+	gs := GraceService{CheckArgs: []string{"-test.run=^$"}}
+	if err := gs.checkBinary(nil); err != nil {
+		t.Fatal(err)
+	}
+	gs.CheckArgs = []string{"-test.no-such-flag"}
+	err := gs.checkBinary(nil)
+	if ce, ok := err.(*CheckError); !ok || !strings.Contains(string(ce.Output), "no-such-flag") {
+		t.Error("Unexpected check result", err)
+	}
+
+	// The arguments of new processor come first, e.g. its config.
+	gs.CheckArgs = []string{"-check"}
+	spec := &RestartSpec{
+		Path: "/bin/sh",
+		Args: []string{"sh", "-c", `echo "$@"; test "$*" = "-config /etc/app.yaml -check"`, "sh", "-config", "/etc/app.yaml"},
+	}
+	if err = gs.checkBinary(spec); err != nil {
+		t.Error("Config not checked", err)
+	}
+}
+
+func TestRestartSpec(t *testing.T) {
+	var gs GraceService
+	gl, err := gs.GetListener("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gl.Close()
+	dir := t.TempDir()
+	logFile, err := os.Create(filepath.Join(dir, "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logFile.Close()
+
+	t.Setenv("GRACE_TEST_OLD", "old")
+	spec := &RestartSpec{
+		Path:  "/bin/sh",
+		Args:  []string{"sh", "-c", `printf '%s %s %s %s' "$PWD" "$GRACE_TEST_NEW" "${GRACE_TEST_OLD-none}" "$_GRACE_FILES" >&4; printf 'ready\n' >&5; exec sleep 10`},
+		Env:   []string{"GRACE_TEST_NEW=new", "GRACE_TEST_OLD", "PWD=" + dir},
+		Dir:   dir,
+		Files: map[string]*os.File{"log": logFile},
+	}
+	p, err := gs.startProcess(gs.registeredSockets(nil), 1, spec, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Kill()
+
+	b, err := os.ReadFile(logFile.Name())
+	if want := dir + " new none log:4"; string(b) != want {
+		t.Errorf("Unexpected new processor %q, want %q, %v", b, want, err)
+	}
+
+	spec.Files = map[string]*os.File{"a,b": logFile}
+	if _, _, err = spec.extraFiles(4); err != errInvalidFileName {
+		t.Error("Invalid file name", err)
+	}
+}
+
+func TestControl(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "control.sock")
+	gs := GraceService{ControlSocket: path}
+	done := make(chan error, 1)
+	go func() {
+		done <- gs.Run(context.Background(), HTTP("unix", filepath.Join(dir, "http.sock"), gs.HealthHandler()))
+	}()
+
+	var (
+		reply *ControlReply
+		err   error
+	)
+	for i := 0; i < 50; i++ {
+		if reply, err = Control(path, ControlStatus); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil || !reply.OK || reply.Pid != os.Getpid() || reply.Restart != "idle" || reply.Draining {
+		t.Fatal("Unexpected status", reply, err)
+	}
+	if reply, err = Control(path, "bogus"); err != nil || reply.OK || reply.Error != errUnknownCommand.Error() {
+		t.Error("Unexpected reply of unknown command", reply, err)
+	}
+	if reply, err = Control(path, ControlDrain); err != nil || !reply.OK || !reply.Draining {
+		t.Error("Unexpected reply of drain", reply, err)
+	}
+	if reply, err = Control(path, ControlStop); err != nil || !reply.OK {
+		t.Error("Unexpected reply of stop", reply, err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run does not return when stopped")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("Control socket file left", err)
+	}
+}
+
+func TestReusePort(t *testing.T) {
+	t.Setenv(envWorkerKey, "1")
+	t.Setenv(envReusePortKey, "1")
+	var gs GraceService
+	gl, err := gs.GetListener("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gl.Close()
+	gl2, err := gs.GetListener("tcp", gl.Addr().String())
+	if err != nil {
+		t.Fatal("Bind by SO_REUSEPORT failed", err)
+	}
+	defer gl2.Close()
+
+	// The master closes sockets workers bind by themselves.
+	t.Setenv(envWorkerKey, "")
+	path := filepath.Join(t.TempDir(), "grace.sock")
+	ul, err := gs.GetListener("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ul.Close()
+	ss := closeReusable(gs.registeredSockets(nil))
+	if len(ss) != 1 || ss[0].s != graceSocket(ul) {
+		t.Error("Unexpected sockets kept", ss)
+	}
+	if _, err = gl.Accept(); err != ErrAlreadyClosed {
+		t.Error("Reusable socket not closed", err)
+	}
+}
+
+func TestSupervise(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "control.sock")
+	slow := filepath.Join(dir, "slow")
+	cmd := helperCommand("supervise", "GRACE_TEST_CONTROL="+path, "GRACE_TEST_SLOW="+slow)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	lines := make(chan string, 16)
+	go func() {
+		s := bufio.NewScanner(stdout)
+		for s.Scan() {
+			lines <- s.Text()
+		}
+		close(lines)
+	}()
+	next := func(kind string) string {
+		select {
+		case line := <-lines:
+			if !strings.HasPrefix(line, kind+" ") {
+				t.Fatal("Unexpected output", line)
+			}
+			return line[len(kind)+1:]
+		case <-time.After(5 * time.Second):
+			t.Fatal("No output of", kind)
+		}
+		return ""
+	}
+	var started []int
+	defer func() {
+		for _, pid := range started {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}()
+	worker := func() int {
+		pid, _ := strconv.Atoi(next("worker"))
+		started = append(started, pid)
+		return pid
+	}
+	workers := func() map[int]bool {
+		return map[int]bool{worker(): true, worker(): true}
+	}
+	exited := func(pid int) bool {
+		for i := 0; i < 100; i++ {
+			if syscall.Kill(pid, 0) == syscall.ESRCH {
+				return true
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		return false
+	}
+
+	addr := next("master")
+	client := http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	servedBy := func(pids map[int]bool) {
+		resp, err := client.Get("http://" + addr + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if pid, _ := strconv.Atoi(string(b)); !pids[pid] {
+			t.Error("Not served by workers", string(b), pids)
+		}
+	}
+
+	old := workers()
+	servedBy(old)
+
+	// Workers are replaced, while the master keeps its pid. HUP while restarting is
+	// coalesced into the restart in flight.
+	cmd.Process.Signal(syscall.SIGHUP)
+	first := worker()
+	cmd.Process.Signal(syscall.SIGHUP)
+	renewed := map[int]bool{first: true, worker(): true}
+	for pid := range old {
+		if renewed[pid] || !exited(pid) {
+			t.Error("Old worker not stopped", pid)
+		}
+	}
+	servedBy(renewed)
+	if syscall.Kill(cmd.Process.Pid, 0) != nil {
+		t.Fatal("Master exited on restart")
+	}
+
+	// The master is controlled like a single processor.
+	reply, err := Control(path, ControlRestart)
+	if err != nil || !reply.OK || reply.Pid != cmd.Process.Pid {
+		t.Fatal("Restart by control socket", reply, err)
+	}
+	old, renewed = renewed, workers()
+	if len(reply.Workers) != 2 || !renewed[reply.Workers[0]] || !renewed[reply.Workers[1]] {
+		t.Error("Unexpected workers", reply.Workers, renewed)
+	}
+	for pid := range old {
+		if !exited(pid) {
+			t.Error("Old worker not stopped", pid)
+		}
+	}
+
+	// The master is controlled and stopped while a new worker is starting.
+	if err = os.WriteFile(slow, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd.Process.Signal(syscall.SIGHUP)
+	starting := worker()
+	if reply, err = Control(path, ControlDrain); err != nil || reply.OK {
+		t.Error("Drain by master", reply, err)
+	}
+	renewed[starting] = true
+
+	// Workers are stopped with the master.
+	cmd.Process.Signal(syscall.SIGTERM)
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Error("Master failed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Master not stopped")
+	}
+	for pid := range renewed {
+		if !exited(pid) {
+			t.Error("Worker not stopped", pid)
+		}
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Error("Control socket file left", err)
+	}
+}
+
+func TestWorkerRespawnDelay(t *testing.T) {
+	w := &worker{delay: workerRespawnDelay}
+	respawn := make(chan *worker, 8)
+	for i := 0; i < 8; i++ {
+		w.respawnAfter(respawn)
+	}
+	if w.delay != workerRespawnMaxDelay {
+		t.Error("Unexpected respawn delay", w.delay)
+	}
+	select {
+	case <-respawn:
+	case <-time.After(2 * workerRespawnDelay):
+		t.Error("Worker not respawned")
+	}
+}
+
+func TestSocketOptions(t *testing.T) {
+	if tcpFastOpen < 0 || tcpDeferAccept < 0 {
+		t.Skip("TCP_FASTOPEN or TCP_DEFER_ACCEPT not supported")
+	}
+	getsockopt := func(l GraceListener, level, opt int) int {
+		c, err := l.(*gListener).GraceListener.(*net.TCPListener).SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v int
+		rawControl(c, func(fd int) error {
+			v, err = syscall.GetsockoptInt(fd, level, opt)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	controlled := 0
+	gs := GraceService{SocketOptions: SocketOptions{
+		Backlog:     16,
+		ReusePort:   true,
+		FastOpen:    8,
+		DeferAccept: time.Second,
+		KeepAlive:   time.Minute,
+		IPv6Only:    true,
+		Control: func(network, address string, c syscall.RawConn) error {
+			controlled++
+			return nil
+		},
+	}}
+	gl, err := gs.GetListener("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("No IPv6", err)
+	}
+	defer gl.Close()
+	if controlled != 1 || getsockopt(gl, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY) != 1 {
+		t.Error("Options before binding not applied", controlled)
+	}
+
+	// Options are applied to inherited listeners created with no options as well.
+	var old GraceService
+	ol, err := old.GetListener("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ol.Close()
+	if err = gs.applyListener(ol.(*gListener)); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range []GraceListener{gl, ol} {
+		if getsockopt(l, syscall.SOL_SOCKET, soReusePort) != 1 ||
+			getsockopt(l, syscall.IPPROTO_TCP, tcpFastOpen) != 8 ||
+			getsockopt(l, syscall.IPPROTO_TCP, tcpDeferAccept) == 0 {
+			t.Error("Options not applied", l.Addr())
+		}
+	}
+}
+
+func TestConnLimit(t *testing.T) {
+	listen := func(lim ConnLimit) GraceListener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewLimitedListener(l.(*net.TCPListener), lim)
+	}
+	accept := func(gl GraceListener) chan net.Conn {
+		ch := make(chan net.Conn, 1)
+		go func() {
+			c, _ := gl.Accept()
+			ch <- c
+		}()
+		return ch
+	}
+
+	// Accept blocks over MaxConns, until a connection is closed or the listener is.
+	gl := listen(ConnLimit{MaxConns: 1})
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", gl.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+	c1 := <-accept(gl)
+	ch := accept(gl)
+	select {
+	case <-ch:
+		t.Fatal("Accepted over MaxConns")
+	case <-time.After(50 * time.Millisecond):
+	}
+	c1.Close()
+	c2 := <-ch
+	if c2 == nil {
+		t.Fatal("Not accepted after a connection closed")
+	}
+	ch = accept(gl)
+	c2.Close()
+	gl.Close()
+	if c := <-ch; c != nil {
+		c.Close()
+	}
+
+	// Connections over MaxConns are rejected.
+	gl = listen(ConnLimit{MaxConns: 1, Reject: true, OnReject: func(c net.Conn) {
+		io.WriteString(c, "busy")
+	}})
+	defer gl.Close()
+	ch = accept(gl)
+	c, err := net.Dial("tcp", gl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c1 = <-ch
+	defer c1.Close()
+	accept(gl)
+	rc, err := net.Dial("tcp", gl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	rc.SetReadDeadline(time.Now().Add(time.Second))
+	if b, err := io.ReadAll(rc); string(b) != "busy" {
+		t.Error("Unexpected rejection", string(b), err)
+	}
+
+	// Rate limit allows Burst connections at once.
+	cl := newConnLimiter(ConnLimit{Rate: 10, Burst: 2})
+	if cl.reserve() != 0 || cl.reserve() != 0 {
+		t.Error("Burst not allowed")
+	}
+	if d := cl.reserve(); d < 90*time.Millisecond || d > 100*time.Millisecond {
+		t.Error("Unexpected rate limit wait", d)
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(verCmd, family byte, body []byte) string {
+		hdr := append([]byte(nil), proxyV2Signature...)
+		hdr = append(hdr, verCmd, family, byte(len(body)>>8), byte(len(body)))
+		return string(append(hdr, body...))
+	}
+	tcp4 := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0x01, 0xbb, 0x04, 0x00} // With a TLV byte
+	tcp6 := append(append(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")...), 0xdc, 0x04, 0x01, 0xbb)
+
+	for _, c := range []struct {
+		header   string
+		optional bool
+		src      string
+		err      error
+	}{
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n", false, "192.0.2.1:56324", nil},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", false, "[2001:db8::1]:56324", nil},
+		{"PROXY UNKNOWN\r\n", false, "", nil},
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 56324\r\n", false, "", errProxyHeader},
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\n", false, "", errProxyHeader},
+		{v2(0x21, 0x11, tcp4), false, "192.0.2.1:56324", nil},
+		{v2(0x21, 0x21, tcp6), false, "[2001:db8::1]:56324", nil},
+		{v2(0x20, 0x00, nil), false, "", nil},
+		{v2(0x21, 0x11, tcp4[:8]), false, "", errProxyHeader},
+		{"GET / HTTP/1.1\r\n", true, "", nil},
+		{"GET / HTTP/1.1\r\n", false, "", errNoProxyHeader},
+	} {
+		r := bufio.NewReader(strings.NewReader(c.header + "data"))
+		src, _, err := readProxyHeader(r, c.optional)
+		if err != c.err || (src == nil) != (c.src == "") || (src != nil && src.String() != c.src) {
+			t.Errorf("%q: unexpected source %v, %v", c.header, src, err)
+			continue
+		}
+		if rest, _ := io.ReadAll(r); err == nil && !strings.HasSuffix(string(rest), "data") {
+			t.Errorf("%q: unexpected data left %q", c.header, rest)
+		}
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	var gs GraceService
+	gl, err := gs.GetListener("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if NewProxyListener(gl, ProxyOptions{}) != gl {
+		t.Fatal("Listener of the service not kept")
+	}
+	go gs.Serve(gl, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.RemoteAddr)
+	}))
+
+	c, err := net.Dial("tcp", gl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\nGET / HTTP/1.0\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "192.0.2.1:56324" {
+		t.Error("Unexpected remote address", string(b))
+	}
+
+	// Headers from untrusted sources are not read.
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	NewProxyListener(gl, ProxyOptions{Trusted: []*net.IPNet{trusted}})
+	c2, err := net.Dial("tcp", gl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	io.WriteString(c2, "GET / HTTP/1.0\r\n\r\n")
+	if resp, err = http.ReadResponse(bufio.NewReader(c2), nil); err != nil {
+		t.Fatal(err)
+	}
+	b, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != c2.LocalAddr().String() {
+		t.Error("Unexpected remote address of untrusted source", string(b))
+	}
+}
+
+func TestProxyDeadline(t *testing.T) {
+	var gs GraceService
+	gl, err := gs.GetListener("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	NewProxyListener(gl, ProxyOptions{})
+	read := make(chan error, 1)
+	go gs.ServeWith(gl, NewConnServer(ConnHandlerFunc(func(ctx context.Context, c net.Conn) {
+		// The deadline is set before the header is read.
+		c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		_, err := c.Read(make([]byte, 1))
+		read <- err
+	})))
+	defer gs.closeListener(nil)
+
+	c, err := net.Dial("tcp", gl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n")
+	select {
+	case err = <-read:
+		if !os.IsTimeout(err) {
+			t.Error("Unexpected read error", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Read deadline lost reading the header")
+	}
+}
@@ -0,0 +1,40 @@
+package grace
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Draining reports whether the service is draining to stop. Handing over to new
+// processor is not regarded as draining, new processor serves the same sockets.
+func (gs *GraceService) Draining() bool {
+	return atomic.LoadInt32(&gs.draining) == 1
+}
+
+// HealthHandler returns a health check handler for load balancers. It responds 503
+// once the service is draining, which begins PreStopDelay before listeners are closed.
+func (gs *GraceService) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if gs.Draining() {
+			w.Header().Set("Connection", "close")
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "ok\n")
+	})
+}
+
+// stop drains to stop the service. Health checks fail at once, but listeners are
+// closed after PreStopDelay, so load balancers have time to stop routing requests here.
+func (gs *GraceService) stop(gl GraceListener) error {
+	gs.drain()
+	time.Sleep(gs.PreStopDelay)
+	return gs.closeListener(gl)
+}
+
+// drain makes health checks fail, see HealthHandler.
+func (gs *GraceService) drain() {
+	atomic.StoreInt32(&gs.draining, 1)
+}
@@ -0,0 +1,315 @@
+package grace
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const envListenersKey = "_GRACE_LISTENERS" // name:fd pairs of sockets passed by old processor
+
+var (
+	errInvalidListenersEnv = errors.New("Invalid " + envListenersKey + " environment")
+	errNoInheritedListener = errors.New("No inherited listener")
+	errInvalidSocketName   = errors.New("Invalid listener name")
+)
+
+// inheritedFile is a socket passed to this process at startup.
+// Each one can be claimed by a single listener.
+type inheritedFile struct {
+	name       string
+	file       *os.File
+	fromParent bool // Passed by old processor rather than systemd
+	claimed    bool
+}
+
+// graceSocket is a GraceListener or GracePacketConn.
+type graceSocket interface {
+	File() (f *os.File, err error)
+	Close() error
+}
+
+// namedSocket is a socket registered to be passed on restart.
+type namedSocket struct {
+	name string
+	s    graceSocket
+}
+
+// inheritedFiles collects the sockets passed to this process, only once.
+func (gs *GraceService) inheritedFiles() ([]*inheritedFile, error) {
+	gs.inheritOnce.Do(func() {
+		if ParentPID() != 0 {
+			gs.inherited, gs.inheritErr = parentFiles()
+		} else {
+			gs.inherited, gs.inheritErr = systemdFiles()
+		}
+	})
+	return gs.inherited, gs.inheritErr
+}
+
+// parentFiles returns the listeners passed by old processor in Restart.
+func parentFiles() (files []*inheritedFile, err error) {
+	v, ok := os.LookupEnv(envListenersKey)
+	if !ok {
+		// Old processor of an earlier release passes its only listener as file descriptor 3
+		return []*inheritedFile{{file: os.NewFile(uintptr(3), ""), fromParent: true}}, nil
+	}
+	if v == "" {
+		return nil, nil
+	}
+
+	for _, item := range strings.Split(v, ",") {
+		i := strings.LastIndex(item, ":")
+		if i < 0 {
+			return nil, errInvalidListenersEnv
+		}
+		fd, err := strconv.Atoi(item[i+1:])
+		if err != nil || fd < 3 {
+			return nil, errInvalidListenersEnv
+		}
+		syscall.CloseOnExec(fd)
+		name := item[:i]
+		files = append(files, &inheritedFile{name: name, file: os.NewFile(uintptr(fd), name), fromParent: true})
+	}
+	return files, nil
+}
+
+// activatedListener returns the inherited listener with the given name, or the one
+// bound to network and addr if no name matches. It returns nil if nothing matches.
+func (gs *GraceService) activatedListener(name, network, addr string) (GraceListener, error) {
+	c, f, err := gs.claimInherited(name, network, addr, func(file *os.File) (io.Closer, net.Addr, error) {
+		l, err := net.FileListener(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		return l, l.Addr(), nil
+	})
+	if c == nil {
+		return nil, err
+	}
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	return gs.inheritedListener(c.(net.Listener), f)
+}
+
+// activatedPacketConn is the packet socket counterpart of activatedListener.
+func (gs *GraceService) activatedPacketConn(name, network, addr string) (GracePacketConn, error) {
+	c, _, err := gs.claimInherited(name, network, addr, func(file *os.File) (io.Closer, net.Addr, error) {
+		pc, err := net.FilePacketConn(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		return pc, pc.LocalAddr(), nil
+	})
+	if c == nil {
+		return nil, err
+	}
+	gpc, ok := c.(GracePacketConn)
+	if !ok {
+		c.Close()
+		return nil, errNotSupportedNetwork
+	}
+	return NewGracePacketConn(gpc), nil
+}
+
+// claimInherited opens the unclaimed inherited socket with the given name, or the one
+// bound to network and addr if no name matches. Sockets open fails on are skipped.
+func (gs *GraceService) claimInherited(name, network, addr string,
+	open func(*os.File) (io.Closer, net.Addr, error)) (io.Closer, *inheritedFile, error) {
+
+	files, err := gs.inheritedFiles()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	claim := func(f *inheritedFile, byName bool) io.Closer {
+		c, a, err := open(f.file)
+		if err != nil {
+			// Another kind of socket
+			return nil
+		}
+		// Name given to systemd is enough, but old processor passes the name with
+		// the old address which may have been changed by new processor.
+		if (byName && !f.fromParent) || addrMatch(network, addr, a) {
+			f.claim()
+			return c
+		}
+		c.Close()
+		return nil
+	}
+
+	if name != "" {
+		for _, f := range files {
+			if !f.claimed && f.name == name {
+				if c := claim(f, true); c != nil {
+					return c, f, nil
+				}
+			}
+		}
+	}
+	for _, f := range files {
+		if !f.claimed {
+			if c := claim(f, false); c != nil {
+				return c, f, nil
+			}
+		}
+	}
+	return nil, nil, nil
+}
+
+// claim marks the file as used. The socket opened holds its own duplicate of the
+// file descriptor, so the inherited one is closed.
+func (f *inheritedFile) claim() {
+	f.claimed = true
+	f.file.Close()
+}
+
+// inheritedListener wraps the listener opened from inherited file f. gs.mu is held.
+func (gs *GraceService) inheritedListener(l net.Listener, f *inheritedFile) (GraceListener, error) {
+	gl, ok := l.(GraceListener)
+	if !ok {
+		l.Close()
+		return nil, errNotSupportedNetwork
+	}
+	if ul, ok := gl.(*net.UnixListener); ok && f.fromParent && !IsWorker() {
+		// The socket file belongs to new processor once it is ready, see ownSocketFiles,
+		// while systemd or the master of workers removes its socket files itself.
+		gs.unixOwned = append(gs.unixOwned, ul)
+	}
+	// Sockets of workers are served by the master and other workers too.
+	return &gListener{GraceListener: gl, shared: IsWorker()}, nil
+}
+
+// ownSocketFiles makes unix listeners inherited from old processor remove their socket
+// files when closed. It is called once old processor hands over after StartupWindow,
+// so failing to start does not remove the socket files old processor still serves.
+func (gs *GraceService) ownSocketFiles() {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	for _, l := range gs.unixOwned {
+		l.SetUnlinkOnClose(true)
+	}
+	gs.unixOwned = nil
+}
+
+// closeUnclaimed closes inherited sockets nobody has been asked for,
+// e.g. listeners dropped by new processor.
+func (gs *GraceService) closeUnclaimed() {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	for _, f := range gs.inherited {
+		if !f.claimed {
+			f.claimed = true
+			f.file.Close()
+		}
+	}
+}
+
+// RegisterListener adds gl to the sockets passed to new processor on restart.
+// Listeners got by GetListener and GetNamedListener are registered already.
+// The name may not contain ",".
+func (gs *GraceService) RegisterListener(name string, gl GraceListener) error {
+	return gs.registerSocket(name, gl)
+}
+
+// RegisterPacketConn adds pc to the sockets passed to new processor on restart.
+// Packet connections got by GetPacketConn and GetNamedPacketConn are registered already.
+// The name may not contain ",".
+func (gs *GraceService) RegisterPacketConn(name string, pc GracePacketConn) error {
+	return gs.registerSocket(name, pc)
+}
+
+func (gs *GraceService) registerSocket(name string, s graceSocket) error {
+	if err := checkSocketName(name); err != nil {
+		return err
+	}
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	for _, ns := range gs.sockets {
+		if ns.s == s {
+			return nil
+		}
+	}
+	gs.sockets = append(gs.sockets, namedSocket{name: name, s: s})
+	return nil
+}
+
+// checkSocketName returns an error if name would break the name:fd pairs passed on restart.
+func checkSocketName(name string) error {
+	if strings.Contains(name, ",") {
+		return errInvalidSocketName
+	}
+	return nil
+}
+
+// registeredSockets returns the registered sockets, plus gl if it is not registered.
+func (gs *GraceService) registeredSockets(gl GraceListener) []namedSocket {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	ss := append([]namedSocket(nil), gs.sockets...)
+	if gl == nil {
+		return ss
+	}
+	for _, ns := range ss {
+		if ns.s == graceSocket(gl) {
+			return ss
+		}
+	}
+	return append(ss, namedSocket{s: gl})
+}
+
+// socketFiles returns the files of sockets to pass on restart and the value of
+// the environment describing them. The first file will be file descriptor 3 in new processor.
+func socketFiles(ss []namedSocket) (files []*os.File, env string, err error) {
+	items := make([]string, 0, len(ss))
+	for i, ns := range ss {
+		f, err := ns.s.File()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, "", err
+		}
+		files = append(files, f)
+		items = append(items, fmt.Sprintf("%s:%d", ns.name, 3+i))
+	}
+	return files, strings.Join(items, ","), nil
+}
+
+// addrMatch reports whether a is the address that network and addr would listen on.
+func addrMatch(network, addr string, a net.Addr) bool {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		got, ok := a.(*net.TCPAddr)
+		want, err := net.ResolveTCPAddr(network, addr)
+		return ok && err == nil && ipPortMatch(want.IP, want.Port, got.IP, got.Port)
+	case "udp", "udp4", "udp6":
+		got, ok := a.(*net.UDPAddr)
+		want, err := net.ResolveUDPAddr(network, addr)
+		return ok && err == nil && ipPortMatch(want.IP, want.Port, got.IP, got.Port)
+	case "unix", "unixpacket", "unixgram":
+		got, ok := a.(*net.UnixAddr)
+		return ok && got.Name == addr
+	}
+	return false
+}
+
+// ipPortMatch reports whether a socket bound to gotIP and gotPort listens on wantIP
+// and wantPort. Unspecified IP matches unspecified IP of any family.
+func ipPortMatch(wantIP net.IP, wantPort int, gotIP net.IP, gotPort int) bool {
+	if wantPort != gotPort {
+		return false
+	}
+	if wantIP == nil || wantIP.IsUnspecified() {
+		return gotIP == nil || gotIP.IsUnspecified()
+	}
+	return wantIP.Equal(gotIP)
+}
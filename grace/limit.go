@@ -0,0 +1,120 @@
+package grace
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// ConnLimit is the overload protection of listeners. Accept blocked by it returns
+// ErrAlreadyClosed once the listener is closed, so draining is never held up.
+type ConnLimit struct {
+	MaxConns int            // Connections open at most, unlimited if 0
+	Reject   bool           // Accept and close connections over MaxConns, rather than block in Accept
+	OnReject func(net.Conn) // Called with rejected connections before closing them, should not block
+	Rate     float64        // Connections accepted per second at most, unlimited if 0
+	Burst    int            // Connections accepted at once in spite of Rate, 1 if 0
+}
+
+// NewLimitedListener returns a GraceListener limiting its connections by lim.
+func NewLimitedListener(l GraceListener, lim ConnLimit) GraceListener {
+	return &gListener{GraceListener: l, limiter: newConnLimiter(lim)}
+}
+
+// connLimiter enforces a ConnLimit. Methods of a nil connLimiter do nothing.
+type connLimiter struct {
+	ConnLimit
+	slots chan struct{} // Holds a value for each connection open, if MaxConns is set
+
+	mu     sync.Mutex
+	tokens float64 // Connections which may be accepted at once
+	last   time.Time
+}
+
+func newConnLimiter(lim ConnLimit) *connLimiter {
+	if lim.MaxConns <= 0 && lim.Rate <= 0 {
+		return nil
+	}
+	cl := &connLimiter{ConnLimit: lim}
+	if lim.MaxConns > 0 {
+		cl.slots = make(chan struct{}, lim.MaxConns)
+	}
+	return cl
+}
+
+// wait waits for the rate limit, and for a free slot unless rejecting connections
+// over MaxConns. It returns ErrAlreadyClosed if done is closed meanwhile.
+func (cl *connLimiter) wait(done <-chan struct{}) error {
+	if cl == nil {
+		return nil
+	}
+	if d := cl.reserve(); d > 0 {
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-done:
+			t.Stop()
+			return ErrAlreadyClosed
+		}
+	}
+	if cl.slots != nil && !cl.Reject {
+		select {
+		case cl.slots <- struct{}{}:
+		case <-done:
+			return ErrAlreadyClosed
+		}
+	}
+	return nil
+}
+
+// reserve takes a token of the rate limit, and returns how long to wait for it.
+func (cl *connLimiter) reserve() time.Duration {
+	if cl.Rate <= 0 {
+		return 0
+	}
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	burst := float64(cl.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	now := time.Now()
+	if cl.last.IsZero() {
+		cl.tokens = burst
+	} else if cl.tokens += now.Sub(cl.last).Seconds() * cl.Rate; cl.tokens > burst {
+		cl.tokens = burst
+	}
+	cl.last = now
+
+	cl.tokens--
+	if cl.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-cl.tokens / cl.Rate * float64(time.Second))
+}
+
+// admit takes a free slot for accepted connection c if rejecting connections over
+// MaxConns. Otherwise c is passed to OnReject and closed, and false is returned.
+func (cl *connLimiter) admit(c net.Conn) bool {
+	if cl == nil || cl.slots == nil || !cl.Reject {
+		return true
+	}
+	select {
+	case cl.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if cl.OnReject != nil {
+		cl.OnReject(c)
+	}
+	c.Close()
+	return false
+}
+
+// release frees the slot of a connection closed.
+func (cl *connLimiter) release() {
+	if cl != nil && cl.slots != nil {
+		<-cl.slots
+	}
+}
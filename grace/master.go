@@ -0,0 +1,357 @@
+package grace
+
+import (
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	envWorkerKey          = "_GRACE_WORKER"
+	envReusePortKey       = "_GRACE_REUSEPORT" // Workers bind tcp and udp sockets by SO_REUSEPORT
+	workerRespawnDelay    = time.Second        // Delay of respawning a crashed worker, doubled on each crash
+	workerRespawnMaxDelay = time.Minute
+	workerStableTime      = time.Minute // Time a worker runs to reset its respawn delay
+)
+
+// IsWorker reports whether this processor is a worker started by Supervise.
+func IsWorker() bool {
+	return os.Getenv(envWorkerKey) == "1"
+}
+
+// reusePort reports whether this processor is a worker binding its own tcp and udp
+// sockets by SO_REUSEPORT.
+func reusePort() bool {
+	return IsWorker() && os.Getenv(envReusePortKey) == "1"
+}
+
+// worker is a worker processor started by Supervise.
+type worker struct {
+	p       *process      // nil while waiting to be respawned
+	started time.Time     // When p is started
+	delay   time.Duration // Delay of respawning p if it crashes
+}
+
+// Supervise runs this processor as the master of Workers worker processors. Workers are
+// started from the same binary and get all registered sockets, just like a restarted
+// processor, so they serve and call CloseParentService and WaitSignal as usual. The
+// master only owns the sockets and keeps its pid while workers are replaced.
+// If ReusePort is set, the master closes its tcp and udp sockets, and workers bind
+// their own ones by SO_REUSEPORT, which the kernel balances connections among.
+// Signals are handled by Signals like WaitSignal, but for workers:
+//
+//	ActionFastStop     : Send TERM to workers and return once they exit
+//	ActionGracefulStop : Send QUIT to workers and return once they exit
+//	ActionRestart      : Check new binary by CheckArgs and replace workers one by one:
+//	                     start new worker, and send QUIT to old one once new one is ready
+//	Others             : Relay the signal to workers
+//
+// Workers are started in background, and stopping aborts those not ready yet. Restart
+// requests received while restarting are coalesced into the restart in flight.
+// A worker which exits unexpectedly is started again, after a delay doubled on each
+// crash. Failures of starting workers are reported by OnRestartError. PidFile holds
+// the pid of the master, and ControlSocket is served by the master, but for ControlDrain
+// as workers serve the health checks.
+func (gs *GraceService) Supervise() error {
+	ss := gs.registeredSockets(nil)
+	if len(ss) == 0 {
+		return errRestartListener
+	}
+	env := []string{envWorkerKey + "=1"}
+	if gs.ReusePort {
+		ss = closeReusable(ss)
+		env = append(env, envReusePortKey+"=1")
+	}
+
+	// Signals are caught from now on, rather than killing the master while starting workers.
+	actions := gs.signalActions()
+	ch := notifySignals(actions)
+	defer signal.Stop(ch)
+
+	// Workers are numbered by their generations.
+	var gen int32
+	done := make(chan struct{})
+	defer close(done)
+	stopping := make(chan struct{}) // Closed to abort starting workers
+	exits := make(chan *process)
+	startWorker := func() (*process, error) {
+		return gs.startProcess(ss, int(atomic.AddInt32(&gen, 1)), gs.RestartSpec, stopping, env...)
+	}
+	var draining []*process // Old workers being gracefully shutdown
+	// attach makes p the process of w, and gracefully stops the one it replaces.
+	attach := func(w *worker, p *process) {
+		old := w.p
+		w.p, w.started = p, time.Now()
+		go func() {
+			<-p.exited
+			select {
+			case exits <- p:
+			case <-done:
+			}
+		}()
+		if old != nil {
+			old.Signal(syscall.SIGQUIT)
+			draining = append(draining, old)
+		}
+	}
+
+	n := gs.Workers
+	if n <= 0 {
+		n = 1
+	}
+	workers := make([]*worker, n)
+	for i := range workers {
+		workers[i] = &worker{delay: workerRespawnDelay}
+		p, err := startWorker()
+		if err != nil {
+			stopProcesses(syscall.SIGTERM, running(workers)...)
+			return err
+		}
+		attach(workers[i], p)
+	}
+	gs.closeUnclaimed()
+	// The control socket is opened after ss, so it is not passed to workers.
+	err := gs.openControl()
+	if err == nil {
+		err = gs.writePidFile()
+	}
+	if err == nil {
+		_, err = notifyReady(nil)
+	}
+	if err != nil {
+		stopProcesses(syscall.SIGTERM, running(workers)...)
+		return err
+	}
+	defer gs.removePidFile()
+
+	reply := func(err error) *ControlReply {
+		r := gs.controlReply(err)
+		for _, p := range running(workers) {
+			r.Workers = append(r.Workers, p.Pid)
+		}
+		return r
+	}
+
+	// Workers are started in background, so signals and control commands are handled
+	// meanwhile, and passed back to be attached here.
+	type startedWorker struct {
+		w       *worker
+		p       *process
+		err     error
+		respawn bool
+	}
+	started := make(chan startedWorker)
+	respawn := make(chan *worker, n) // Crashed workers to be respawned
+	respawning := 0                  // Workers being respawned
+	startRespawn := func(w *worker) {
+		respawning++
+		go func() {
+			p, err := startWorker()
+			started <- startedWorker{w: w, p: p, err: err, respawn: true}
+		}()
+	}
+
+	// Rolling restart, stopped by the first failure. Workers not replaced yet go on
+	// serving. Restart requests received meanwhile are coalesced into the one in flight.
+	var (
+		restarting chan error
+		waiters    []chan *ControlReply // Control connections waiting for the restart in flight
+	)
+	startRestart := func() {
+		if restarting != nil {
+			return
+		}
+		result := make(chan error, 1)
+		go func() {
+			if err := gs.checkBinary(gs.RestartSpec); err != nil {
+				result <- err
+				return
+			}
+			for _, w := range workers {
+				p, err := startWorker()
+				if err != nil {
+					result <- err
+					return
+				}
+				started <- startedWorker{w: w, p: p}
+			}
+			result <- nil
+		}()
+		restarting = result
+	}
+	endRestart := func(err error) {
+		restarting = nil
+		if err != nil {
+			gs.reportRestartError(err)
+		}
+		for _, w := range waiters {
+			w <- reply(err)
+		}
+		waiters = nil
+	}
+	attachStarted := func(s startedWorker) {
+		if s.respawn {
+			respawning--
+			if s.err != nil {
+				gs.reportRestartError(s.err)
+				select {
+				case <-stopping:
+				default:
+					s.w.respawnAfter(respawn)
+				}
+				return
+			}
+		} else {
+			s.w.delay = workerRespawnDelay
+		}
+		attach(s.w, s.p)
+	}
+
+	stop := func(sig syscall.Signal) error {
+		// Workers being started are aborted, or stopped with the others.
+		close(stopping)
+		for respawning > 0 || restarting != nil {
+			select {
+			case s := <-started:
+				attachStarted(s)
+			case err := <-restarting:
+				endRestart(err)
+			}
+		}
+		stopProcesses(sig, append(draining, running(workers)...)...)
+		// Workers have exited, close the sockets and the control socket.
+		return gs.closeListener(nil)
+	}
+
+	gs.mu.Lock()
+	control := gs.control
+	gs.mu.Unlock()
+	for {
+		select {
+		case req := <-control:
+			switch req.cmd {
+			case ControlRestart:
+				waiters = append(waiters, req.reply)
+				startRestart()
+			case ControlStop:
+				req.reply <- reply(nil)
+				return stop(syscall.SIGQUIT)
+			case ControlDrain:
+				// Workers serve the health checks.
+				req.reply <- reply(errControlUnsupported)
+			default:
+				req.reply <- reply(errUnknownCommand)
+			}
+		case sig := <-ch:
+			switch actions[sig] {
+			case ActionFastStop:
+				return stop(syscall.SIGTERM)
+			case ActionGracefulStop:
+				return stop(syscall.SIGQUIT)
+			case ActionRestart:
+				startRestart()
+			case ActionReload, ActionReopenLogs, ActionCustom:
+				// Workers do the work.
+				for _, p := range running(workers) {
+					p.Signal(sig)
+				}
+			}
+		case s := <-started:
+			attachStarted(s)
+		case err := <-restarting:
+			endRestart(err)
+		case p := <-exits:
+			for _, w := range workers {
+				if w.p != p {
+					continue
+				}
+				// Not an old worker draining, respawn it.
+				gs.reportRestartError(&RestartError{Pid: p.Pid, State: p.state, Err: errWorkerExited})
+				w.p = nil
+				if time.Since(w.started) >= workerStableTime {
+					w.delay = workerRespawnDelay
+				}
+				w.respawnAfter(respawn)
+				break
+			}
+		case w := <-respawn:
+			if w.p != nil {
+				// Replaced by restart meanwhile.
+				continue
+			}
+			startRespawn(w)
+		}
+		draining = reapExited(draining)
+	}
+}
+
+// respawnAfter sends w to respawn after its delay, and doubles the delay.
+func (w *worker) respawnAfter(respawn chan<- *worker) {
+	time.AfterFunc(w.delay, func() {
+		respawn <- w
+	})
+	if w.delay *= 2; w.delay > workerRespawnMaxDelay {
+		w.delay = workerRespawnMaxDelay
+	}
+}
+
+// running returns the processes of workers running.
+func running(workers []*worker) []*process {
+	ps := make([]*process, 0, len(workers))
+	for _, w := range workers {
+		if w.p != nil {
+			ps = append(ps, w.p)
+		}
+	}
+	return reapExited(ps)
+}
+
+// closeReusable closes the tcp and udp sockets in ss, which workers bind by SO_REUSEPORT,
+// and returns the others.
+func closeReusable(ss []namedSocket) []namedSocket {
+	kept := ss[:0]
+	for _, ns := range ss {
+		var network string
+		switch s := ns.s.(type) {
+		case GraceListener:
+			network = s.Addr().Network()
+		case GracePacketConn:
+			network = s.LocalAddr().Network()
+		}
+		if network == "tcp" || network == "udp" {
+			ns.s.Close()
+			continue
+		}
+		kept = append(kept, ns)
+	}
+	return kept
+}
+
+// stopProcesses sends sig to the running processes in ps, and waits for them to exit.
+func stopProcesses(sig syscall.Signal, ps ...*process) {
+	ps = reapExited(ps)
+	for _, p := range ps {
+		p.Signal(sig)
+	}
+	for _, p := range ps {
+		<-p.exited
+	}
+}
+
+// reapExited removes exited and nil processes from ps.
+func reapExited(ps []*process) []*process {
+	running := ps[:0]
+	for _, p := range ps {
+		if p == nil {
+			continue
+		}
+		select {
+		case <-p.exited:
+		default:
+			running = append(running, p)
+		}
+	}
+	return running
+}
@@ -0,0 +1,130 @@
+package grace
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// GracePacketConn is the packet socket counterpart of GraceListener, e.g. UDPConn or
+// UnixConn of unixgram network. It is passed to child process by file descriptor too.
+type GracePacketConn interface {
+	net.PacketConn
+	File() (f *os.File, err error) // Get file descriptor
+}
+
+type gPacketConn struct {
+	GracePacketConn
+	closed      bool
+	closedMutex sync.RWMutex
+	wg          sync.WaitGroup // Pending reads
+}
+
+func NewGracePacketConn(c GracePacketConn) GracePacketConn {
+	return &gPacketConn{GracePacketConn: c}
+}
+
+// Close stops reading. Pending ReadFrom returns ErrAlreadyClosed, then the socket is closed.
+// New processor keeps reading from its own file descriptor of the socket.
+func (c *gPacketConn) Close() error {
+	c.closedMutex.Lock()
+	if c.closed {
+		c.closedMutex.Unlock()
+		return ErrAlreadyClosed
+	}
+	c.closed = true
+	c.closedMutex.Unlock()
+
+	err := c.GracePacketConn.SetReadDeadline(time.Now())
+	c.wg.Wait()
+	if e := c.GracePacketConn.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+func (c *gPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.wg.Add(1)
+	defer c.wg.Done()
+
+	c.closedMutex.RLock()
+	if c.closed {
+		c.closedMutex.RUnlock()
+		return 0, nil, ErrAlreadyClosed
+	}
+	c.closedMutex.RUnlock()
+
+	n, addr, err := c.GracePacketConn.ReadFrom(b)
+	if err != nil {
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			c.closedMutex.RLock()
+			defer c.closedMutex.RUnlock()
+			if c.closed {
+				return 0, nil, ErrAlreadyClosed
+			}
+		}
+	}
+	return n, addr, err
+}
+
+// GetPacketConn returns the packet socket inherited from old processor or passed by
+// systemd socket activation, or creates a new one bound to network and addr.
+func (gs *GraceService) GetPacketConn(network, addr string) (GracePacketConn, error) {
+	return gs.GetNamedPacketConn("", network, addr)
+}
+
+// GetNamedPacketConn is like GetPacketConn, but prefers the inherited socket with
+// the given name. The name is kept when the socket is passed to new processor, and
+// may not contain ",".
+func (gs *GraceService) GetNamedPacketConn(name, network, addr string) (pc GracePacketConn, err error) {
+	if err = checkSocketName(name); err != nil {
+		return nil, err
+	}
+	if err = gs.checkPidFile(); err != nil {
+		return nil, err
+	}
+
+	pc, err = gs.activatedPacketConn(name, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if pc == nil {
+		switch network {
+		case "udp", "udp4", "udp6":
+			c, err := gs.listenConfig().ListenPacket(context.Background(), network, addr)
+			if err != nil {
+				return nil, err
+			}
+			pc = NewGracePacketConn(c.(*net.UDPConn))
+		case "unixgram":
+			if err = removeStaleSocket(network, addr); err != nil {
+				return nil, err
+			}
+			unixAddr, err := net.ResolveUnixAddr(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			c, err := net.ListenUnixgram(network, unixAddr)
+			if err != nil {
+				return nil, err
+			}
+			if err = gs.setSocketFileOwner(addr); err != nil {
+				c.Close()
+				return nil, err
+			}
+			pc = NewGracePacketConn(c)
+		default:
+			return nil, errNotSupportedNetwork
+		}
+	}
+
+	if err = gs.applyPacketConn(pc); err != nil {
+		pc.Close()
+		return nil, err
+	}
+	gs.RegisterPacketConn(name, pc)
+	return
+}
@@ -0,0 +1,89 @@
+package grace
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var errPidFileInUse = errors.New("Pid file is held by a running process")
+
+// checkPidFile fails if PidFile holds the pid of another running process.
+// Restarted processors and workers skip the check, their parent holds the file.
+func (gs *GraceService) checkPidFile() error {
+	if gs.PidFile == "" || ParentPID() != 0 {
+		return nil
+	}
+	pid, err := readPidFile(gs.PidFile)
+	if err != nil || pid == os.Getpid() {
+		// No pid file or nothing valid in it
+		return nil
+	}
+	if err = syscall.Kill(pid, 0); err == nil || err == syscall.EPERM {
+		return errPidFileInUse
+	}
+	return nil
+}
+
+// writePidFile replaces PidFile by a file holding our pid.
+func (gs *GraceService) writePidFile() error {
+	if gs.PidFile == "" || IsWorker() {
+		return nil
+	}
+
+	dir, base := filepath.Split(gs.PidFile)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := os.CreateTemp(dir, base+".")
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), gs.PidFile)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// removePidFile removes PidFile if it still holds our pid, which is not the case
+// after new processor has taken over.
+func (gs *GraceService) removePidFile() {
+	if gs.PidFile == "" {
+		return
+	}
+	if pid, err := readPidFile(gs.PidFile); err == nil && pid == os.Getpid() {
+		os.Remove(gs.PidFile)
+	}
+}
+
+// reclaimPidFile writes PidFile again if it holds the pid of new processor which has
+// failed to start, e.g. exited in StartupWindow after writing the file.
+func (gs *GraceService) reclaimPidFile(pid int) {
+	if gs.PidFile == "" {
+		return
+	}
+	if got, err := readPidFile(gs.PidFile); err == nil && got == pid {
+		gs.writePidFile()
+	}
+}
+
+func readPidFile(path string) (int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
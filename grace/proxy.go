@@ -0,0 +1,230 @@
+package grace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultProxyTimeout = 5 * time.Second
+	proxyV1MaxLen       = 107 // Longest v1 header including CRLF
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var (
+	errProxyHeader   = errors.New("Invalid PROXY protocol header")
+	errNoProxyHeader = errors.New("No PROXY protocol header")
+)
+
+// ProxyOptions tells how the PROXY protocol header sent by load balancers is read.
+type ProxyOptions struct {
+	Timeout  time.Duration // Time to read the header, 5 seconds if 0
+	Trusted  []*net.IPNet  // Sources allowed to send the header, all if empty
+	Optional bool          // Serve connections with no header as is, rather than fail reading them
+}
+
+// NewProxyListener returns a GraceListener serving PROXY protocol v1 and v2 on l.
+// The header is read on the first Read or RemoteAddr of a connection from a trusted
+// source, and RemoteAddr and LocalAddr return the addresses in the header. Connections
+// from other sources are served as is. If l is made by this package, l itself is
+// returned serving PROXY protocol, so its connections are still tracked for draining
+// and it is still passed to new processor on restart.
+func NewProxyListener(l GraceListener, opts ProxyOptions) GraceListener {
+	gl, ok := l.(*gListener)
+	if !ok {
+		gl = &gListener{GraceListener: l}
+	}
+	gl.closedMutex.Lock()
+	gl.proxy = &opts
+	gl.closedMutex.Unlock()
+	return gl
+}
+
+// trusted reports whether the header from addr is trusted.
+func (o *ProxyOptions) trusted(addr net.Addr) bool {
+	if len(o.Trusted) == 0 {
+		return true
+	}
+	ta, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range o.Trusted {
+		if n.Contains(ta.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConn reads the PROXY protocol header of a connection once.
+type proxyConn struct {
+	opts *ProxyOptions
+	once sync.Once
+	r    *bufio.Reader
+	src  net.Addr // Addresses in the header, nil if none
+	dst  net.Addr
+	err  error
+
+	mu             sync.Mutex
+	readDeadline   time.Time // Set by the user of the connection
+	headerDeadline time.Time // Set while reading the header
+}
+
+// init reads the header from c, keeping the read deadline set by the user.
+func (p *proxyConn) init(c net.Conn) error {
+	p.once.Do(func() {
+		p.r = bufio.NewReader(c)
+		if !p.opts.trusted(c.RemoteAddr()) {
+			return
+		}
+		timeout := p.opts.Timeout
+		if timeout == 0 {
+			timeout = defaultProxyTimeout
+		}
+		p.mu.Lock()
+		p.headerDeadline = time.Now().Add(timeout)
+		c.SetReadDeadline(earliest(p.headerDeadline, p.readDeadline))
+		p.mu.Unlock()
+
+		p.src, p.dst, p.err = readProxyHeader(p.r, p.opts.Optional)
+
+		p.mu.Lock()
+		p.headerDeadline = time.Time{}
+		c.SetReadDeadline(p.readDeadline)
+		p.mu.Unlock()
+	})
+	return p.err
+}
+
+// setReadDeadline sets the read deadline of c for the user, which is brought forward
+// to the header deadline while reading the header.
+func (p *proxyConn) setReadDeadline(c net.Conn, t time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.readDeadline = t
+	return c.SetReadDeadline(earliest(p.headerDeadline, t))
+}
+
+// earliest returns the earlier deadline of a and b, zero meaning none.
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// readProxyHeader reads a v1 or v2 header from r, and returns the source and
+// destination addresses, which are nil if the header has none.
+func readProxyHeader(r *bufio.Reader, optional bool) (src, dst net.Addr, err error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case b[0] == 'P':
+		if b, err = r.Peek(6); err == nil && string(b) == "PROXY " {
+			return readProxyV1(r)
+		}
+	case b[0] == proxyV2Signature[0]:
+		if b, err = r.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(b, proxyV2Signature) {
+			return readProxyV2(r)
+		}
+	}
+	if optional && (err == nil || err == io.EOF) {
+		return nil, nil, nil
+	}
+	if err == nil {
+		err = errNoProxyHeader
+	}
+	return nil, nil, err
+}
+
+// readProxyV1 reads a header like "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n".
+func readProxyV1(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errProxyHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errProxyHeader
+	}
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil {
+		return nil, nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+// readProxyV2 reads a binary header, ignoring its TLVs.
+func readProxyV2(r *bufio.Reader) (src, dst net.Addr, err error) {
+	hdr := make([]byte, len(proxyV2Signature)+4)
+	if _, err = io.ReadFull(r, hdr); err != nil {
+		return nil, nil, err
+	}
+	verCmd, family := hdr[12], hdr[13]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err = io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	if verCmd>>4 != 2 {
+		return nil, nil, errProxyHeader
+	}
+	switch verCmd & 0xf {
+	case 0:
+		// LOCAL, e.g. health checks of the proxy itself.
+		return nil, nil, nil
+	case 1:
+		// PROXY
+	default:
+		return nil, nil, errProxyHeader
+	}
+
+	var ipLen int
+	switch family >> 4 {
+	case 1:
+		ipLen = net.IPv4len
+	case 2:
+		ipLen = net.IPv6len
+	default:
+		// AF_UNSPEC or AF_UNIX, keep the addresses of the connection.
+		return nil, nil, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, nil, errProxyHeader
+	}
+	srcIP := net.IP(append([]byte(nil), body[:ipLen]...))
+	dstIP := net.IP(append([]byte(nil), body[ipLen:2*ipLen]...))
+	srcPort := int(binary.BigEndian.Uint16(body[2*ipLen:]))
+	dstPort := int(binary.BigEndian.Uint16(body[2*ipLen+2:]))
+	if family&0xf == 2 {
+		return &net.UDPAddr{IP: srcIP, Port: srcPort}, &net.UDPAddr{IP: dstIP, Port: dstPort}, nil
+	}
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}, nil
+}
@@ -0,0 +1,162 @@
+package grace
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	envReadyFDKey       = "_GRACE_READY_FD" // Pipe new processor writes readyMessage to
+	readyMessage        = "ready\n"
+	handOverMessage     = "hand over\n" // Written back once new processor runs through StartupWindow
+	defaultReadyTimeout = time.Minute
+)
+
+var (
+	errNotReady       = errors.New("New processor exited before ready")
+	errReadyTimeout   = errors.New("New processor ready timeout")
+	errStartupExited  = errors.New("New processor exited in startup window")
+	errBadReadyNotify = errors.New("Bad ready message")
+	errWorkerExited   = errors.New("Worker exited unexpectedly")
+	errStartAborted   = errors.New("Starting new processor aborted")
+)
+
+// RestartError is returned by Restart if new processor fails to start.
+// New processor has exited or been killed, and old processor goes on serving.
+type RestartError struct {
+	Pid   int              // Process id of new processor
+	State *os.ProcessState // Exit state of new processor
+	Err   error            // Why new processor is regarded as failed
+}
+
+func (e *RestartError) Error() string {
+	return fmt.Sprintf("Restart pid %d failed: %v (%v)", e.Pid, e.Err, e.State)
+}
+
+// process is a started processor watched until it exits.
+type process struct {
+	*os.Process
+	exited chan struct{}    // Closed when the process exits
+	state  *os.ProcessState // Valid after exited is closed
+}
+
+func watchProcess(p *os.Process) *process {
+	proc := &process{Process: p, exited: make(chan struct{})}
+	go func() {
+		proc.state, _ = p.Wait()
+		close(proc.exited)
+	}()
+	return proc
+}
+
+// fail kills the process and returns the RestartError caused by err.
+func (p *process) fail(err error) *RestartError {
+	p.Kill()
+	<-p.exited
+	return &RestartError{Pid: p.Pid, State: p.state, Err: err}
+}
+
+// readyPipe returns a connected pair of files, the second one being passed to new
+// processor. New processor writes readyMessage to it, and old processor writes back
+// handOverMessage. The first one is nonblocking, so reading it can time out.
+func readyPipe() (r, w *os.File, err error) {
+	syscall.ForkLock.RLock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = syscall.SetNonblock(fds[0], true); err != nil {
+		syscall.Close(fds[0])
+		syscall.Close(fds[1])
+		return nil, nil, err
+	}
+	return os.NewFile(uintptr(fds[0]), "ready"), os.NewFile(uintptr(fds[1]), "ready"), nil
+}
+
+// waitReady waits for new processor p to write readyMessage to r, and then to keep
+// running in StartupWindow. p is killed if it is not ready in ReadyTimeout. Then
+// handOverMessage is written to r.
+func (gs *GraceService) waitReady(p *process, r *os.File) error {
+	timeout := gs.ReadyTimeout
+	if timeout == 0 {
+		timeout = defaultReadyTimeout
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		msg := make([]byte, len(readyMessage))
+		err := r.SetReadDeadline(time.Now().Add(timeout))
+		if err == nil {
+			_, err = io.ReadFull(r, msg)
+		}
+		if err == nil && string(msg) != readyMessage {
+			err = errBadReadyNotify
+		}
+		ready <- err
+	}()
+
+	select {
+	case err := <-ready:
+		if os.IsTimeout(err) {
+			return p.fail(errReadyTimeout)
+		} else if err != nil {
+			return p.fail(errNotReady)
+		}
+	case <-p.exited:
+		// The message may have been written just before exiting.
+		if err := <-ready; err == nil {
+			return p.fail(errStartupExited)
+		}
+		return p.fail(errNotReady)
+	}
+
+	if gs.StartupWindow > 0 {
+		select {
+		case <-p.exited:
+			return p.fail(errStartupExited)
+		case <-time.After(gs.StartupWindow):
+		}
+	}
+	io.WriteString(r, handOverMessage)
+	return nil
+}
+
+// notifyReady writes readyMessage to the pipe passed by old processor, and then calls
+// handedOver in background once old processor writes back handOverMessage or exits.
+// It returns false if old processor does not wait for a ready message.
+func notifyReady(handedOver func()) (bool, error) {
+	v := os.Getenv(envReadyFDKey)
+	if v == "" {
+		return false, nil
+	}
+	fd, err := strconv.Atoi(v)
+	if err != nil || fd < 3 {
+		return false, nil
+	}
+
+	syscall.CloseOnExec(fd)
+	f := os.NewFile(uintptr(fd), "ready")
+	if _, err = io.WriteString(f, readyMessage); err != nil {
+		f.Close()
+		return true, err
+	}
+	go func() {
+		defer f.Close()
+		msg := make([]byte, len(handOverMessage))
+		_, err := io.ReadFull(f, msg)
+		if (err != nil || string(msg) == handOverMessage) && handedOver != nil {
+			handedOver()
+		}
+	}()
+	return true, nil
+}
@@ -0,0 +1,69 @@
+package grace
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// AddReloadHook adds hook to the functions called by Reload.
+func (gs *GraceService) AddReloadHook(hook func() error) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.reloadHooks = append(gs.reloadHooks, hook)
+}
+
+// Reload reloads in process, without a new processor. It calls OnReload and the reload
+// hooks in order, and stops at the first error. It is called on ActionReload, and the
+// processor restarts if Reload fails.
+func (gs *GraceService) Reload() error {
+	gs.mu.Lock()
+	hooks := append([]func() error(nil), gs.reloadHooks...)
+	gs.mu.Unlock()
+	if gs.OnReload != nil {
+		hooks = append([]func() error{gs.OnReload}, hooks...)
+	}
+
+	for _, hook := range hooks {
+		if err := hook(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SwappableHandler is a http.Handler whose handler can be swapped while serving,
+// e.g. by a reload hook. Requests being served keep the handler they started with.
+type SwappableHandler struct {
+	v atomic.Value // handlerHolder
+}
+
+// handlerHolder keeps the type stored in atomic.Value consistent.
+type handlerHolder struct {
+	http.Handler
+}
+
+func NewSwappableHandler(h http.Handler) *SwappableHandler {
+	sh := new(SwappableHandler)
+	sh.Swap(h)
+	return sh
+}
+
+// Swap makes h serve the requests from now on.
+func (sh *SwappableHandler) Swap(h http.Handler) {
+	sh.v.Store(handlerHolder{h})
+}
+
+// Handler returns the handler serving requests.
+func (sh *SwappableHandler) Handler() http.Handler {
+	h, _ := sh.v.Load().(handlerHolder)
+	return h.Handler
+}
+
+func (sh *SwappableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h := sh.Handler()
+	if h == nil {
+		http.NotFound(w, r)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
@@ -0,0 +1,157 @@
+package grace
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const (
+	envGenerationKey = "_GRACE_GENERATION" // Generation of new processor, set by its parent
+	envParentPIDKey  = "_GRACE_PARENT_PID" // Pid of old processor or master starting new processor
+	envRestartKey    = "_GRACE_RESTART"    // Set to 1 by old processors of earlier releases
+)
+
+var (
+	lineageOnce sync.Once
+	generation  int
+	parentPID   int
+)
+
+// readLineage reads the generation and parent pid passed by the parent processor.
+func readLineage() {
+	lineageOnce.Do(func() {
+		v, ok := os.LookupEnv(envParentPIDKey)
+		if !ok && os.Getenv(envRestartKey) == "1" {
+			// Old processor of an earlier release passes its only listener as file
+			// descriptor 3, and waits for QUIT signal from its child.
+			if pid := os.Getppid(); pid != 1 {
+				generation, parentPID = 1, pid
+			}
+			return
+		}
+		pid, err := strconv.Atoi(v)
+		if err != nil || pid <= 0 {
+			return
+		}
+		gen, err := strconv.Atoi(os.Getenv(envGenerationKey))
+		if err != nil || gen <= 0 {
+			return
+		}
+		generation, parentPID = gen, pid
+	})
+}
+
+// Generation returns the generation of this processor. It is 0 if started by user or
+// systemd, one more than old processor if started by Restart, and counts the workers
+// started by the master if started by Supervise.
+func Generation() int {
+	readLineage()
+	return generation
+}
+
+// ParentPID returns the pid of old processor or master which started this processor,
+// or 0 if started by user or systemd. Old processor may have exited since.
+func ParentPID() int {
+	readLineage()
+	return parentPID
+}
+
+// IsRestarted reports whether this processor is started by Restart of old processor.
+func IsRestarted() bool {
+	return ParentPID() != 0 && !IsWorker()
+}
+
+var (
+	ErrRestartInProgress = errors.New("Restart already in progress")
+	ErrReplaced          = errors.New("Processor already replaced")
+)
+
+// RestartState is the state of restarting a service. A service starts one new
+// processor at a time, and is replaced at most once.
+type RestartState int
+
+const (
+	RestartIdle RestartState = iota // No restart in flight
+	Restarting                      // New processor is started and not yet ready
+	Replaced                        // New processor is ready, this one drains
+)
+
+var restartStateNames = []string{"idle", "restarting", "replaced"}
+
+func (s RestartState) String() string {
+	if s < 0 || int(s) >= len(restartStateNames) {
+		return "unknown"
+	}
+	return restartStateNames[s]
+}
+
+// RestartStatus describes the restart of a service.
+type RestartStatus struct {
+	State RestartState
+	Pid   int // Process id of new processor, 0 if RestartIdle
+}
+
+// RestartStatus returns the restart status of the service.
+func (gs *GraceService) RestartStatus() RestartStatus {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	st := RestartStatus{State: gs.restartState}
+	if gs.child != nil {
+		st.Pid = gs.child.Pid
+	}
+	return st
+}
+
+// beginRestart moves to Restarting. It fails if a restart is in flight, or the
+// service has been replaced already.
+func (gs *GraceService) beginRestart() error {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	switch gs.restartState {
+	case Restarting:
+		return ErrRestartInProgress
+	case Replaced:
+		return ErrReplaced
+	}
+	gs.restartState = Restarting
+	return nil
+}
+
+// setChild records new processor p of the restart in flight. p is killed if the
+// restart has been aborted before p is recorded.
+func (gs *GraceService) setChild(p *process) {
+	gs.mu.Lock()
+	gs.child = p
+	aborted := gs.restartAborted
+	gs.mu.Unlock()
+	if aborted {
+		p.Kill()
+	}
+}
+
+// endRestart moves to Replaced if the restart succeeded, or back to RestartIdle.
+func (gs *GraceService) endRestart(err error) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.restartAborted = false
+	if err == nil {
+		gs.restartState = Replaced
+	} else {
+		gs.restartState = RestartIdle
+		gs.child = nil
+	}
+}
+
+// abortRestart kills new processor of the restart in flight, which makes Restart fail.
+func (gs *GraceService) abortRestart() {
+	gs.mu.Lock()
+	p := gs.child
+	abort := gs.restartState == Restarting
+	gs.restartAborted = abort
+	gs.mu.Unlock()
+	if p != nil && abort {
+		p.Kill()
+	}
+}
@@ -0,0 +1,54 @@
+package grace
+
+import (
+	"context"
+	"net/http"
+)
+
+// Binding tells Run to serve the listener got by GetNamedListener with Server.
+type Binding struct {
+	Name    string // Name of the listener passed to new processor, may be empty
+	Network string
+	Addr    string
+	Server  Server
+}
+
+// HTTP returns the Binding serving handler by http on network and addr.
+func HTTP(network, addr string, handler http.Handler) Binding {
+	return Binding{Network: network, Addr: addr, Server: HTTPServer(&http.Server{Handler: handler})}
+}
+
+// Run is the whole life of a service processor. It gets the listeners of bindings and
+// serves them, tells old processor it is ready by CloseParentService, and then handles
+// signals like WaitSignal. Run returns when a signal terminates the processor, or
+// drains and returns when ctx is done or a server fails. The error of the failed
+// server is returned, otherwise the error of draining.
+func (gs *GraceService) Run(ctx context.Context, bindings ...Binding) error {
+	gls := make([]GraceListener, 0, len(bindings))
+	for _, b := range bindings {
+		gl, err := gs.GetNamedListener(b.Name, b.Network, b.Addr)
+		if err != nil {
+			for _, gl := range gls {
+				gl.Close()
+			}
+			return err
+		}
+		gls = append(gls, gl)
+	}
+
+	serveErr := make(chan error, len(bindings))
+	for i, b := range bindings {
+		go func(gl GraceListener, srv Server) {
+			err := gs.ServeWith(gl, srv)
+			if err != nil && err != ErrServerClosed && err != http.ErrServerClosed {
+				serveErr <- err
+			}
+		}(gls[i], b.Server)
+	}
+
+	if err := gs.CloseParentService(); err != nil {
+		gs.closeListener(nil)
+		return err
+	}
+	return gs.waitSignal(ctx, nil, serveErr)
+}
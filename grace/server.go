@@ -0,0 +1,203 @@
+package grace
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// ErrServerClosed is returned by Serve of servers made by this package after shutdown.
+var ErrServerClosed = errors.New("Server closed")
+
+// Server is served on listeners by GraceService. When the service drains, Shutdown is
+// called to stop serving gracefully, and Close is called to stop by force if Shutdown
+// does not return before ListenerCloseTimeout. *http.Server implements Server, but
+// should be wrapped by HTTPServer to tell idle connections.
+type Server interface {
+	Serve(l net.Listener) error
+	Shutdown(ctx context.Context) error
+	Close() error
+}
+
+// HTTPServer tracks whether connections of srv are idle, so idle ones are closed first
+// when draining. ConnState of srv is still called.
+func HTTPServer(srv *http.Server) Server {
+	connState := srv.ConnState
+	srv.ConnState = func(c net.Conn, state http.ConnState) {
+		markIdle(c, state)
+		if connState != nil {
+			connState(c, state)
+		}
+	}
+	return srv
+}
+
+// A ConnHandler serves a connection accepted by the server made by NewConnServer.
+// ctx is cancelled when the server begins to shutdown, then the handler should
+// finish its work and return. The connection is closed after the handler returns.
+type ConnHandler interface {
+	ServeConn(ctx context.Context, c net.Conn)
+}
+
+// The ConnHandlerFunc type is an adapter to allow the use of ordinary functions as ConnHandler.
+type ConnHandlerFunc func(ctx context.Context, c net.Conn)
+
+func (f ConnHandlerFunc) ServeConn(ctx context.Context, c net.Conn) {
+	f(ctx, c)
+}
+
+// NewConnServer returns a Server running an accept loop, which serves each connection
+// by handler in its own goroutine.
+func NewConnServer(handler ConnHandler) Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &connServer{
+		handler:   handler,
+		ctx:       ctx,
+		cancel:    cancel,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+type connServer struct {
+	handler ConnHandler
+	ctx     context.Context // Cancelled on shutdown
+	cancel  context.CancelFunc
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup // Connections being served
+}
+
+func (s *connServer) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			delete(s.listeners, l)
+			if s.closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			c.Close()
+			return ErrServerClosed
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.serveConn(c)
+	}
+}
+
+func (s *connServer) serveConn(c net.Conn) {
+	defer func() {
+		c.Close()
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		s.wg.Done()
+	}()
+	s.handler.ServeConn(s.ctx, c)
+}
+
+// closeListeners stops accepting and tells handlers to finish.
+func (s *connServer) closeListeners() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.cancel()
+
+	var err error
+	for l := range s.listeners {
+		if e := l.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Shutdown stops accepting, cancels the context of handlers and waits for them to return.
+func (s *connServer) Shutdown(ctx context.Context) error {
+	err := s.closeListeners()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting and closes all connections.
+func (s *connServer) Close() error {
+	err := s.closeListeners()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.Close()
+	}
+	return err
+}
+
+// GracefulStopper is a server stopped gracefully without a deadline, like grpc.Server.
+type GracefulStopper interface {
+	Serve(l net.Listener) error
+	GracefulStop() // Stop accepting and wait for connections to finish
+	Stop()         // Stop accepting and close connections
+}
+
+// NewStopperServer adapts s to Server. Shutdown calls Stop when the context is done.
+func NewStopperServer(s GracefulStopper) Server {
+	return stopperServer{s}
+}
+
+type stopperServer struct {
+	GracefulStopper
+}
+
+func (s stopperServer) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.Stop()
+		return ctx.Err()
+	}
+}
+
+func (s stopperServer) Close() error {
+	s.Stop()
+	return nil
+}
@@ -0,0 +1,78 @@
+package grace
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Action is what is done on a signal by WaitSignal.
+type Action int
+
+const (
+	ActionNone         Action = iota // Ignore the signal
+	ActionFastStop                   // Return at once without draining
+	ActionGracefulStop               // Drain and return
+	ActionRestart                    // Restart, then drain and return once new processor is ready
+	ActionReload                     // Call Reload, and restart if it fails
+	ActionReopenLogs                 // Call OnReopenLogs
+	ActionCustom                     // Call OnSignal
+)
+
+// DefaultSignals is used if Signals of GraceService is nil. For instance, USR2 could
+// restart while HUP reloads configure:
+//
+//	gs.Signals = map[os.Signal]grace.Action{
+//		syscall.SIGTERM: grace.ActionFastStop,
+//		syscall.SIGINT:  grace.ActionFastStop,
+//		syscall.SIGQUIT: grace.ActionGracefulStop,
+//		syscall.SIGHUP:  grace.ActionReload,
+//		syscall.SIGUSR1: grace.ActionReopenLogs,
+//		syscall.SIGUSR2: grace.ActionRestart,
+//	}
+var DefaultSignals = map[os.Signal]Action{
+	syscall.SIGTERM: ActionFastStop,     // TERM : Shutdown
+	syscall.SIGINT:  ActionFastStop,     // INT  : Shutdown
+	syscall.SIGQUIT: ActionGracefulStop, // QUIT : Gracefully shutdown
+	syscall.SIGHUP:  ActionRestart,      // HUP  : Gracefully reload configure and restart
+}
+
+func (gs *GraceService) signalActions() map[os.Signal]Action {
+	if gs.Signals != nil {
+		return gs.Signals
+	}
+	return DefaultSignals
+}
+
+// notifySignals relays the signals in actions.
+func notifySignals(actions map[os.Signal]Action) chan os.Signal {
+	ch := make(chan os.Signal, 6)
+	for sig := range actions {
+		signal.Notify(ch, sig)
+	}
+	return ch
+}
+
+// handleSignal does the actions which keep the processor serving, but ActionReload.
+func (gs *GraceService) handleSignal(sig os.Signal, action Action) {
+	var err error
+	switch action {
+	case ActionReopenLogs:
+		if gs.OnReopenLogs != nil {
+			err = gs.OnReopenLogs()
+		}
+	case ActionCustom:
+		if gs.OnSignal != nil {
+			err = gs.OnSignal(sig)
+		}
+	}
+	if err != nil {
+		gs.reportSignalError(sig, err)
+	}
+}
+
+func (gs *GraceService) reportSignalError(sig os.Signal, err error) {
+	if gs.OnSignalError != nil {
+		gs.OnSignalError(sig, err)
+	}
+}
@@ -0,0 +1,137 @@
+package grace
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+var errSocketOptionUnsupported = errors.New("Socket option is not supported")
+
+// SocketOptions are applied to tcp and udp sockets created by GetNamedListener and
+// GetNamedPacketConn. Those which can be set on bound sockets are applied to inherited
+// sockets too, so new processor matches old one even if it changes the options.
+type SocketOptions struct {
+	Backlog     int           // Listen backlog of tcp listeners, the system default if 0, inherited too
+	ReusePort   bool          // Set SO_REUSEPORT, inherited too
+	FastOpen    int           // Queue length of TCP_FASTOPEN on linux, disabled if 0, inherited too
+	DeferAccept time.Duration // TCP_DEFER_ACCEPT on linux, disabled if 0, inherited too
+	KeepAlive   time.Duration // Keepalive period of accepted tcp connections, disabled if negative, inherited too
+	IPv6Only    bool          // Set IPV6_V6ONLY on IPv6 sockets, which are not dual stack then
+
+	// Control is called with the socket created before binding, after the options above.
+	Control func(network, address string, c syscall.RawConn) error
+}
+
+// listenConfig returns the config binding new tcp and udp sockets.
+func (gs *GraceService) listenConfig() *net.ListenConfig {
+	o := gs.SocketOptions
+	if reusePort() {
+		o.ReusePort = true
+	}
+	return &net.ListenConfig{
+		KeepAlive: o.KeepAlive,
+		Control: func(network, address string, c syscall.RawConn) error {
+			err := rawControl(c, func(fd int) error {
+				if o.ReusePort {
+					if err := setReusePort(fd); err != nil {
+						return err
+					}
+				}
+				if o.IPv6Only {
+					if sa, err := syscall.Getsockname(fd); err == nil {
+						if _, ok := sa.(*syscall.SockaddrInet6); ok {
+							return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 1)
+						}
+					}
+				}
+				return nil
+			})
+			if err == nil && o.Control != nil {
+				err = o.Control(network, address, c)
+			}
+			return err
+		},
+	}
+}
+
+// applyListener applies the options which can be changed on listening sockets to the
+// tcp listener l, created or inherited.
+func (gs *GraceService) applyListener(l *gListener) error {
+	o := gs.SocketOptions
+	tl, ok := l.GraceListener.(*net.TCPListener)
+	if !ok {
+		return nil
+	}
+	l.keepAlive = o.KeepAlive
+	c, err := tl.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return rawControl(c, func(fd int) error {
+		if o.ReusePort {
+			if err := setReusePort(fd); err != nil {
+				return err
+			}
+		}
+		if o.FastOpen > 0 {
+			if tcpFastOpen < 0 {
+				return errSocketOptionUnsupported
+			}
+			if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, tcpFastOpen, o.FastOpen); err != nil {
+				return err
+			}
+		}
+		if o.DeferAccept > 0 {
+			if tcpDeferAccept < 0 {
+				return errSocketOptionUnsupported
+			}
+			secs := int((o.DeferAccept + time.Second - 1) / time.Second)
+			if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, tcpDeferAccept, secs); err != nil {
+				return err
+			}
+		}
+		if o.Backlog > 0 {
+			// Listening again changes the backlog of a listening socket.
+			return syscall.Listen(fd, o.Backlog)
+		}
+		return nil
+	})
+}
+
+// applyPacketConn applies the options which can be changed on bound sockets to the
+// udp socket pc, created or inherited.
+func (gs *GraceService) applyPacketConn(pc GracePacketConn) error {
+	gpc, ok := pc.(*gPacketConn)
+	if !ok || !gs.SocketOptions.ReusePort {
+		return nil
+	}
+	uc, ok := gpc.GracePacketConn.(*net.UDPConn)
+	if !ok {
+		return nil
+	}
+	c, err := uc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return rawControl(c, setReusePort)
+}
+
+// rawControl calls f with the file descriptor of c.
+func rawControl(c syscall.RawConn, f func(fd int) error) error {
+	var err error
+	if e := c.Control(func(fd uintptr) {
+		err = f(int(fd))
+	}); e != nil {
+		return e
+	}
+	return err
+}
+
+func setReusePort(fd int) error {
+	if soReusePort < 0 {
+		return errSocketOptionUnsupported
+	}
+	return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, soReusePort, 1)
+}
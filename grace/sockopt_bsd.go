@@ -0,0 +1,11 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package grace
+
+import "syscall"
+
+const (
+	soReusePort    = syscall.SO_REUSEPORT
+	tcpFastOpen    = -1 // Not supported
+	tcpDeferAccept = -1 // Not supported
+)
@@ -0,0 +1,9 @@
+package grace
+
+import "syscall"
+
+const (
+	soReusePort    = 0xf  // SO_REUSEPORT, missing in package syscall on linux
+	tcpFastOpen    = 0x17 // TCP_FASTOPEN, missing in package syscall on linux
+	tcpDeferAccept = syscall.TCP_DEFER_ACCEPT
+)
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package grace
+
+// Not supported
+const (
+	soReusePort    = -1
+	tcpFastOpen    = -1
+	tcpDeferAccept = -1
+)
@@ -0,0 +1,142 @@
+package grace
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const envFilesKey = "_GRACE_FILES" // name:fd pairs of extra files passed by old processor
+
+var errInvalidFileName = errors.New("Invalid restart file name")
+
+// RestartSpec tells how new processor is started on restart. Zero fields keep those of
+// this processor, so a nil spec starts new processor just like this one.
+type RestartSpec struct {
+	Path  string              // Binary of new processor, os.Args[0] looked up in PATH if empty
+	Args  []string            // Arguments of new processor including argv[0], os.Args if nil
+	Env   []string            // "key=value" overriding the environment of this processor, "key" removing
+	Dir   string              // Working directory of new processor, the current one if empty
+	Files map[string]*os.File // Extra files passed to new processor, see InheritedFile
+}
+
+// command returns the binary, arguments and working directory of new processor.
+func (s *RestartSpec) command() (path string, args []string, dir string, err error) {
+	if s == nil {
+		s = &RestartSpec{}
+	}
+
+	// Use the original binary location by default. This works with symlinks such that
+	// if the file it points to has been changed we will use the updated symlink.
+	path = s.Path
+	if path == "" {
+		path = os.Args[0]
+	}
+	if path, err = exec.LookPath(path); err != nil {
+		return "", nil, "", err
+	}
+
+	args = s.Args
+	if args == nil {
+		args = os.Args
+	}
+
+	// In order to keep the working directory the same as when we started.
+	dir = s.Dir
+	if dir == "" {
+		if dir, err = os.Getwd(); err != nil {
+			return "", nil, "", err
+		}
+	}
+	return path, args, dir, nil
+}
+
+// environ returns the environment of new processor without the variables passing
+// sockets and roles.
+func (s *RestartSpec) environ() []string {
+	env := baseEnv()
+	if s == nil {
+		return env
+	}
+	for _, kv := range s.Env {
+		key := kv
+		if i := strings.Index(kv, "="); i >= 0 {
+			key = kv[:i]
+		}
+		kept := env[:0]
+		for _, v := range env {
+			if !strings.HasPrefix(v, key+"=") {
+				kept = append(kept, v)
+			}
+		}
+		env = kept
+		if key != kv {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// extraFiles returns the extra files sorted by name, and their name:fd pairs, the
+// first one being fd.
+func (s *RestartSpec) extraFiles(fd int) (files []*os.File, env string, err error) {
+	if s == nil || len(s.Files) == 0 {
+		return nil, "", nil
+	}
+	names := make([]string, 0, len(s.Files))
+	for name := range s.Files {
+		if name == "" || strings.ContainsAny(name, ",:") {
+			return nil, "", errInvalidFileName
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	items := make([]string, 0, len(names))
+	for i, name := range names {
+		files = append(files, s.Files[name])
+		items = append(items, fmt.Sprintf("%s:%d", name, fd+i))
+	}
+	return files, strings.Join(items, ","), nil
+}
+
+var (
+	filesOnce   sync.Once
+	passedFiles map[string]*os.File // Extra files passed by old processor and not got yet
+	filesMu     sync.Mutex
+)
+
+// InheritedFile returns the extra file passed by old processor as name in
+// RestartSpec.Files, or nil if there is none. Each file is returned only once.
+func InheritedFile(name string) *os.File {
+	filesOnce.Do(func() {
+		passedFiles = make(map[string]*os.File)
+		if ParentPID() == 0 {
+			return
+		}
+		for _, item := range strings.Split(os.Getenv(envFilesKey), ",") {
+			i := strings.LastIndex(item, ":")
+			if i < 0 {
+				continue
+			}
+			fd, err := strconv.Atoi(item[i+1:])
+			if err != nil || fd < 3 {
+				continue
+			}
+			syscall.CloseOnExec(fd)
+			passedFiles[item[:i]] = os.NewFile(uintptr(fd), item[:i])
+		}
+	})
+
+	filesMu.Lock()
+	defer filesMu.Unlock()
+	f := passedFiles[name]
+	delete(passedFiles, name)
+	return f
+}
@@ -0,0 +1,64 @@
+package grace
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Environment variables of the systemd socket activation protocol, see sd_listen_fds(3).
+const (
+	envListenPID     = "LISTEN_PID"
+	envListenFDs     = "LISTEN_FDS"
+	envListenFDNames = "LISTEN_FDNAMES"
+	listenFDsStart   = 3 // SD_LISTEN_FDS_START
+)
+
+var errInvalidListenFDs = errors.New("Invalid LISTEN_FDS environment")
+
+// systemdFiles returns the file descriptors passed by systemd socket activation.
+// The LISTEN_* environment is always cleared, so it is not passed to child processes.
+func systemdFiles() (files []*inheritedFile, err error) {
+	defer func() {
+		os.Unsetenv(envListenPID)
+		os.Unsetenv(envListenFDs)
+		os.Unsetenv(envListenFDNames)
+	}()
+
+	// The sockets are addressed to another process, e.g. our parent.
+	pid, err := strconv.Atoi(os.Getenv(envListenPID))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv(envListenFDs))
+	if err != nil || n < 0 {
+		return nil, errInvalidListenFDs
+	}
+
+	var names []string
+	if s := os.Getenv(envListenFDNames); s != "" {
+		names = strings.Split(s, ":")
+	}
+
+	for i := 0; i < n; i++ {
+		fd := listenFDsStart + i
+		// systemd does not set close-on-exec, keep the sockets out of restarted processes.
+		syscall.CloseOnExec(fd)
+		var name string
+		if i < len(names) {
+			name = names[i]
+		}
+		files = append(files, &inheritedFile{name: name, file: os.NewFile(uintptr(fd), name)})
+	}
+	return files, nil
+}
+
+// isSystemdEnv reports whether the environment entry v belongs to socket activation.
+func isSystemdEnv(v string) bool {
+	return strings.HasPrefix(v, envListenPID+"=") ||
+		strings.HasPrefix(v, envListenFDs+"=") ||
+		strings.HasPrefix(v, envListenFDNames+"=")
+}
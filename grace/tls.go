@@ -0,0 +1,156 @@
+package grace
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errNoCertificate = errors.New("No certificate")
+
+// KeyPair is the files of a certificate chain and its private key, in PEM format.
+type KeyPair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// CertStore serves certificates loaded from files by GetCertificate of tls.Config, and
+// reloads them without restarting. The certificate is chosen by SNI, the first one is
+// served if none matches. A restarted processor loads the files itself.
+type CertStore struct {
+	pairs []KeyPair
+	certs atomic.Value // []*tls.Certificate
+
+	mu      sync.Mutex // Serializes reloading
+	modTime map[string]time.Time
+}
+
+// NewCertStore loads the certificates of pairs.
+func NewCertStore(pairs ...KeyPair) (*CertStore, error) {
+	if len(pairs) == 0 {
+		return nil, errNoCertificate
+	}
+	cs := &CertStore{pairs: pairs}
+	if err := cs.Reload(); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// Reload loads the certificates again. If any of them fails, the certificates loaded
+// before are kept. Handshakes in progress go on with the certificates they have got.
+func (cs *CertStore) Reload() error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	modTime := make(map[string]time.Time)
+	certs := make([]*tls.Certificate, 0, len(cs.pairs))
+	for _, p := range cs.pairs {
+		for _, name := range []string{p.CertFile, p.KeyFile} {
+			fi, err := os.Stat(name)
+			if err != nil {
+				return err
+			}
+			modTime[name] = fi.ModTime()
+		}
+
+		cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+		if err != nil {
+			return err
+		}
+		if cert.Leaf == nil {
+			if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return err
+			}
+		}
+		certs = append(certs, &cert)
+	}
+
+	cs.certs.Store(certs)
+	cs.modTime = modTime
+	return nil
+}
+
+// GetCertificate is used as GetCertificate of tls.Config.
+func (cs *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certs := cs.certs.Load().([]*tls.Certificate)
+	if hello.ServerName != "" {
+		for _, cert := range certs {
+			if hello.SupportsCertificate(cert) == nil {
+				return cert, nil
+			}
+		}
+	}
+	return certs[0], nil
+}
+
+// Watch reloads the certificates when their files are modified, checking every interval,
+// until ctx is done. Failures of reloading are reported by onError, which may be nil.
+func (cs *CertStore) Watch(ctx context.Context, interval time.Duration, onError func(error)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		if !cs.modified() {
+			continue
+		}
+		if err := cs.Reload(); err != nil && onError != nil {
+			onError(err)
+		}
+	}
+}
+
+// modified reports whether any file has been modified since loaded.
+func (cs *CertStore) modified() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for name, t := range cs.modTime {
+		fi, err := os.Stat(name)
+		if err != nil || !fi.ModTime().Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeTLS serves https requests on gl with the certificates of cs, until the service
+// is shutdown. cs is reloaded by Reload of the service, i.e. on ActionReload.
+func (gs *GraceService) ServeTLS(gl GraceListener, handler http.Handler, cs *CertStore) error {
+	gs.mu.Lock()
+	if !gs.certStores[cs] {
+		if gs.certStores == nil {
+			gs.certStores = make(map[*CertStore]bool)
+		}
+		gs.certStores[cs] = true
+		gs.reloadHooks = append(gs.reloadHooks, cs.Reload)
+	}
+	gs.mu.Unlock()
+
+	srv := &http.Server{
+		Handler:   handler,
+		TLSConfig: &tls.Config{GetCertificate: cs.GetCertificate},
+	}
+	HTTPServer(srv)
+	return gs.ServeWith(gl, tlsServer{srv})
+}
+
+// tlsServer serves https on listeners.
+type tlsServer struct {
+	*http.Server
+}
+
+func (s tlsServer) Serve(l net.Listener) error {
+	return s.ServeTLS(l, "", "")
+}
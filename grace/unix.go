@@ -0,0 +1,133 @@
+package grace
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errSocketInUse      = errors.New("Socket file is in use")
+	errNotSocketFile    = errors.New("File exists and is not a socket")
+	errInvalidFileOwner = errors.New("Invalid socket file owner")
+)
+
+// listenUnix creates a unix domain socket listener.
+func (gs *GraceService) listenUnix(network, path string) (GraceListener, error) {
+	if err := removeStaleSocket(network, path); err != nil {
+		return nil, err
+	}
+
+	addr, err := net.ResolveUnixAddr(network, path)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.ListenUnix(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = gs.setSocketFileOwner(path); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return NewGraceListener(l), nil
+}
+
+// isAbstract reports whether path is in the abstract namespace, which has no socket file.
+func isAbstract(path string) bool {
+	return strings.HasPrefix(path, "@")
+}
+
+// removeStaleSocket removes the socket file left by a processor which has exited.
+// A socket file which is still served by another processor is kept.
+func removeStaleSocket(network, path string) error {
+	if isAbstract(path) {
+		return nil
+	}
+
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return errNotSocketFile
+	}
+
+	c, err := net.DialTimeout(network, path, time.Second)
+	if err == nil {
+		c.Close()
+		return errSocketInUse
+	}
+	return os.Remove(path)
+}
+
+// setSocketFileOwner applies SocketFileMode and SocketFileOwner to the socket file.
+func (gs *GraceService) setSocketFileOwner(path string) error {
+	if isAbstract(path) {
+		return nil
+	}
+	if gs.SocketFileMode != 0 {
+		if err := os.Chmod(path, gs.SocketFileMode); err != nil {
+			return err
+		}
+	}
+	if gs.SocketFileOwner == "" {
+		return nil
+	}
+
+	uid, gid, err := lookupOwner(gs.SocketFileOwner)
+	if err != nil {
+		return err
+	}
+	return os.Lchown(path, uid, gid)
+}
+
+// lookupOwner parses "user[:group]" with names or numeric ids. Missing group is -1.
+func lookupOwner(owner string) (uid, gid int, err error) {
+	userName, groupName := owner, ""
+	if i := strings.Index(owner, ":"); i >= 0 {
+		userName, groupName = owner[:i], owner[i+1:]
+	}
+
+	uid, gid = -1, -1
+	if userName != "" {
+		if uid, err = strconv.Atoi(userName); err != nil {
+			u, err := user.Lookup(userName)
+			if err != nil {
+				return 0, 0, err
+			}
+			if uid, err = strconv.Atoi(u.Uid); err != nil {
+				return 0, 0, errInvalidFileOwner
+			}
+		}
+	}
+	if groupName != "" {
+		if gid, err = strconv.Atoi(groupName); err != nil {
+			g, err := user.LookupGroup(groupName)
+			if err != nil {
+				return 0, 0, err
+			}
+			if gid, err = strconv.Atoi(g.Gid); err != nil {
+				return 0, 0, errInvalidFileOwner
+			}
+		}
+	}
+	return uid, gid, nil
+}
+
+// keepSocketFile stops s removing its socket file when closed.
+func keepSocketFile(s graceSocket) {
+	if l, ok := s.(*gListener); ok {
+		s = l.GraceListener
+	}
+	if l, ok := s.(*net.UnixListener); ok {
+		l.SetUnlinkOnClose(false)
+	}
+}